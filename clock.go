@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/dotabuff/manta"
+)
+
+/* How long the pre-game (from heroes spawning to the horn) lasts, in seconds. */
+const PRE_GAME_DURATION = 90.0
+
+/*
+	The game clock, as kept by the game rules (CDOTAGamerulesProxy).
+	Game time doesn't advance while the game is paused, so this is what the bot API's DotaTime() is based on.
+*/
+type GameClock struct {
+	GameTime         float32 // seconds since the server started, not counting pauses
+	GameStartTime    float32 // game time of the horn, 0 until then
+	PreGameStartTime float32 // game time the pre-game started at, 0 until then
+	Paused           bool
+}
+
+/* Picks up the current time and pause state. Needs to be called on every update of the game rules. */
+func (clock *GameClock) Update(ent *manta.PacketEntity) {
+	if time, ok := ent.FetchFloat32("m_pGameRules.m_fGameTime"); ok {
+		clock.GameTime = time
+	}
+
+	if time, ok := ent.FetchFloat32("m_pGameRules.m_flGameStartTime"); ok {
+		clock.GameStartTime = time
+	}
+
+	if time, ok := ent.FetchFloat32("m_pGameRules.m_flPreGameStartTime"); ok {
+		clock.PreGameStartTime = time
+	}
+
+	if paused, ok := ent.FetchBool("m_pGameRules.m_bGamePaused"); ok {
+		clock.Paused = paused
+	}
+}
+
+/* Returns DotaTime(): seconds since the horn, negative during the pre-game. Not ok before the pre-game starts. */
+func (clock *GameClock) DotaTime() (float32, bool) {
+	if clock.GameStartTime != 0 {
+		return clock.GameTime - clock.GameStartTime, true
+	} else if clock.PreGameStartTime != 0 {
+		return clock.GameTime - (clock.PreGameStartTime + PRE_GAME_DURATION), true
+	}
+
+	return 0.0, false
+}
+
+/* Returns how many minutes have passed since the horn (0 before it). */
+func (clock *GameClock) Minutes() float32 {
+	if time, ok := clock.DotaTime(); ok && time > 0 {
+		return time / 60.0
+	}
+
+	return 0.0
+}
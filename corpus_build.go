@@ -3,50 +3,161 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"flag"
 	"fmt"
 	"github.com/dotabuff/manta"
 	"github.com/dotabuff/manta/dota"
 	"log"
-	"math"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 )
 
 /* Represents the corpus of examples for one hero. */
 type Corpus struct {
-	MoveFile *os.File
-	ItemFile *os.File
-	Move     *bufio.Writer
-	Item     *bufio.Writer
+	MoveFile  *os.File
+	ItemFile  *os.File
+	SkillFile *os.File
+	Move      *bufio.Writer
+	Item      *bufio.Writer
+	Skill     *bufio.Writer
 
 	ObservedItems           map[string]int
 	ObservedAbilities       []string
 	ObservedActiveAbilities map[string]int
 	ObservedActiveItems     map[string]int
-}
-
-/* Represents a player to pay attention to in the first pass. */
-type TopPlayer struct {
-	Kills int32
-	Name  string
+	ObservedSkills          map[string]int
+	ObservedEnemyHeroes     map[string]int
+	ObservedHeroes          map[string]int
 }
 
 type Hero struct {
 	Team     uint64
 	Entindex int32
+	PlayerID int32 // -1 until it's known
+	Illusion bool
+	Clone    bool // a real hero that isn't the one the player picked (Meepo clones, Tempest Double)
+}
+
+/* Everything the first pass finds out about a match. */
+type Match struct {
+	Players     []*Player
+	Teams       map[string]uint64 // hero -> team
+	WinningTeam uint64            // 0 if it couldn't be found
+	WinnerFrom  string            // how the winner was decided
+}
+
+/* An example that can be written to a corpus. */
+type Example interface {
+	SetDotaTime(time float32)
+	WriteToCorpus(corpus *Corpus)
+}
+
+/* An example waiting to be written to the corpus of a hero. */
+type PendingExample struct {
+	Hero     string
+	Team     uint64
+	PlayerID int32
+	Tick     uint32
+	Example  Example
+}
+
+/* A parsed demo, waiting for its examples to be written to the corpora. */
+type ParsedDemo struct {
+	Index    int
+	Name     string
+	Match    *Match
+	Examples []*PendingExample
+	Err      error // why the demo was skipped, if it was
 }
 
+/* Unit order types (dotaunitorder_t), as sent in CDOTAUserMsg_SpectatorPlayerUnitOrders. */
 const (
-	TargetTower = iota + 1
-	TargetBuilding
-	TargetSelf
-	TargetTree
-	TargetJungle
-	TargetLane
-	TargetEnemyHero
-	TargetFriendlyHero
+	OrderNone = iota
+	OrderMoveToPosition
+	OrderMoveToTarget
+	OrderAttackMove
+	OrderAttackTarget
+	OrderCastPosition
+	OrderCastTarget
+	OrderCastTargetTree
+	OrderCastNoTarget
+	OrderCastToggle
+	OrderHoldPosition
+	OrderTrainAbility
+	OrderDropItem
+	OrderGiveItem
+	OrderPickupItem
+	OrderPickupRune
+	OrderPurchaseItem
+	OrderSellItem
+	OrderDisassembleItem
+	OrderMoveItem
+	OrderCastToggleAuto
+	OrderStop
+	OrderTaunt
+	OrderBuyback
+	OrderGlyph
+	OrderEjectItemFromStash
+	OrderCastRune
+	OrderPingAbility
+	OrderMoveToDirection
+	OrderPatrol
+	OrderVectorTargetPosition
+	OrderRadar
+	OrderSetItemCombineLock
+	OrderContinue
 )
 
+/* Names of the order types, in order (written out so the trainer knows how many there are). */
+var orderNames []string = []string{
+	"none",
+	"moveToPosition",
+	"moveToTarget",
+	"attackMove",
+	"attackTarget",
+	"castPosition",
+	"castTarget",
+	"castTargetTree",
+	"castNoTarget",
+	"castToggle",
+	"holdPosition",
+	"trainAbility",
+	"dropItem",
+	"giveItem",
+	"pickupItem",
+	"pickupRune",
+	"purchaseItem",
+	"sellItem",
+	"disassembleItem",
+	"moveItem",
+	"castToggleAuto",
+	"stop",
+	"taunt",
+	"buyback",
+	"glyph",
+	"ejectItemFromStash",
+	"castRune",
+	"pingAbility",
+	"moveToDirection",
+	"patrol",
+	"vectorTargetPosition",
+	"radar",
+	"setItemCombineLock",
+	"continue",
+}
+
+/* Orders that use an ability or item. Other orders can carry an ability index too (pings, moving items around...) without using it. */
+func IsCastOrder(order int) bool {
+	switch order {
+	case OrderCastPosition, OrderCastTarget, OrderCastTargetTree, OrderCastNoTarget, OrderCastToggle, OrderCastToggleAuto, OrderVectorTargetPosition, OrderCastRune:
+		return true
+	}
+
+	return false
+}
+
 /* Represents a move/attack example. */
 type MoveExample struct {
 	DotaTime   float32
@@ -56,29 +167,56 @@ type MoveExample struct {
 	Level      float32
 	CurrentX   float32
 	CurrentY   float32
+	UnitType   int
+
+	State HeroState // only the groups switched on in features are written
 
 	OtherX [9]float32
 	OtherY [9]float32
 
+	EnemySinceSeen [5]float32 // only with features.FogOfWar
+	OtherHeroes    [9]string  // who's in each slot, only with features.HeroIdentities
+
+	Modifiers [10][]float32 // which of modifierNames are on the unit and whether it's channelling, then the same for each of the other heroes (nil for empty slots), only with features.Modifiers
+
+	NearestUnits []NearbyUnit // closest first, only with features.NearestUnits
+
 	AbilityCooldowns []float32
-	CurrentItems     []int
+	Abilities        []string // names of the abilities the cooldowns belong to
+
+	Inventory [USABLE_SLOTS]ItemSlot
+	Backpack  []string
+	Stash     []string
 
 	IsAttack float32
-	MoveX    float32
-	MoveY    float32
+
+	/* Each of these only means something if its mask is 1 (they're 0 otherwise) */
+	HasMove         float32 // where the unit was told to go
+	MoveX           float32
+	MoveY           float32
+	HasTargetPos    float32 // where an ability or attack was aimed (the target entity's position, or the ground)
+	TargetX         float32
+	TargetY         float32
+	HasTargetEntity float32 // what an ability or attack was aimed at (Target)
 
 	Target      int
-	AbilityUsed int
-	ItemUsed    int
+	AbilityUsed string // "" if none
+	ItemUsed    string // "" if none
+	OrderType   int    // one of the Order* constants
+	Queued      bool   // shift-queued
+}
+
+func (example *MoveExample) SetDotaTime(time float32) {
+	example.DotaTime = time
 }
 
-/* Writes a move example to CSV. */
+/* Writes a move example to CSV. Names are turned into IDs here, so IDs get handed out in the order examples are written. */
 func (example *MoveExample) WriteToCorpus(corpus *Corpus) {
 	/* Input:
 	   current time, health, mana, position of the creep front, XP level,
 	   positions of all the players, ability cooldowns and current items.
 	*/
-	corpus.Move.WriteString(fmt.Sprintf("%f,%f,%f,%f,%f,%f,%f,",
+	corpus.Move.WriteString(fmt.Sprintf("%f,%f,%f,%f,%f,%f,%f,%d,",
 		example.DotaTime,
 		example.Health,
 		example.Mana,
@@ -86,63 +224,409 @@ func (example *MoveExample) WriteToCorpus(corpus *Corpus) {
 		example.CreepFront,
 		example.CurrentX,
 		example.CurrentY,
+		example.UnitType,
 	))
 
+	state := &example.State
+
+	if features.Economy {
+		corpus.Move.WriteString(fmt.Sprintf("%f,%f,%f,", state.ReliableGold, state.UnreliableGold, state.NetWorth))
+	}
+
+	if features.Farm {
+		corpus.Move.WriteString(fmt.Sprintf("%f,%f,", state.LastHits, state.Denies))
+	}
+
+	if features.Attributes {
+		corpus.Move.WriteString(fmt.Sprintf("%f,%f,%f,", state.Strength, state.Agility, state.Intelligence))
+	}
+
+	if features.Combat {
+		corpus.Move.WriteString(fmt.Sprintf("%f,%f,%f,%f,", state.Damage, state.Armor, state.MoveSpeed, state.AttackRange))
+	}
+
+	if features.Alive {
+		corpus.Move.WriteString(fmt.Sprintf("%f,", state.Alive))
+	}
+
 	for i := 0; i < 9; i++ {
 		corpus.Move.WriteString(fmt.Sprintf("%f,%f,", example.OtherX[i], example.OtherY[i]))
 	}
 
+	if features.FogOfWar {
+		for _, since := range example.EnemySinceSeen {
+			corpus.Move.WriteString(fmt.Sprintf("%f,", since))
+		}
+	}
+
+	if features.HeroIdentities {
+		for _, hero := range example.OtherHeroes {
+			if hero == "" {
+				corpus.Move.WriteString("0,")
+			} else {
+				corpus.Move.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedHeroes, hero)))
+			}
+		}
+	}
+
+	for i := 0; i < features.NearestUnits; i++ {
+		if i < len(example.NearestUnits) {
+			unit := example.NearestUnits[i]
+			corpus.Move.WriteString(fmt.Sprintf("1,%f,%f,%f,%f,%d,", unit.DX, unit.DY, unit.Health, unit.Allied, unit.Type))
+		} else {
+			corpus.Move.WriteString("0,0,0,0,0,0,")
+		}
+	}
+
+	if features.Modifiers {
+		for _, active := range example.Modifiers {
+			for i := 0; i < modifierColumns; i++ {
+				if active == nil {
+					corpus.Move.WriteString("0,")
+				} else {
+					corpus.Move.WriteString(fmt.Sprintf("%d,", int(active[i])))
+				}
+			}
+		}
+	}
+
 	for _, cooldown := range example.AbilityCooldowns {
 		corpus.Move.WriteString(fmt.Sprintf("%f,", cooldown))
 	}
 
+	for ability_id, name := range example.Abilities {
+		if len(corpus.ObservedAbilities) <= ability_id {
+			corpus.ObservedAbilities = append(corpus.ObservedAbilities, name)
+		}
+	}
+
 	corpus.Move.WriteString("items,")
 
-	for _, item := range example.CurrentItems {
-		corpus.Move.WriteString(fmt.Sprintf("%d,", item))
+	for _, slot := range example.Inventory {
+		id := 0
+
+		if slot.Name != "" {
+			id = Observe(corpus.ObservedItems, slot.Name) + 1
+		}
+
+		corpus.Move.WriteString(fmt.Sprintf("%d,%f,%d,%f,", id, slot.Usable, slot.Charges, slot.Cooldown))
+	}
+
+	corpus.Move.WriteString("backpack,")
+
+	for _, item := range example.Backpack {
+		corpus.Move.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedItems, item)))
+	}
+
+	corpus.Move.WriteString("stash,")
+
+	for _, item := range example.Stash {
+		corpus.Move.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedItems, item)))
 	}
 
 	/* Output:
-	   move position, label of the target for abilities/attacks, label of the ability and/or item used
+	   move destination, target position, label of the target for abilities/attacks (all with masks),
+	   label of the ability and/or item used, order type
 	*/
 	corpus.Move.WriteString("output,")
 
-	corpus.Move.WriteString(fmt.Sprintf("%f,%f,%f,%d,%d,%d\n",
+	queued := 1
+
+	if example.Queued {
+		queued = 2
+	}
+
+	corpus.Move.WriteString(fmt.Sprintf("%f,%f,%f,%f,%f,%f,%f,%f,%d,%d,%d,%d,%d\n",
 		example.IsAttack,
+		example.HasMove,
 		example.MoveX,
 		example.MoveY,
+		example.HasTargetPos,
+		example.TargetX,
+		example.TargetY,
+		example.HasTargetEntity,
 
 		example.Target,
-		example.AbilityUsed,
-		example.ItemUsed,
+		ObserveLabel(corpus.ObservedActiveAbilities, example.AbilityUsed),
+		ObserveLabel(corpus.ObservedActiveItems, example.ItemUsed),
+		example.OrderType+1,
+		queued,
 	))
 }
 
-/* Represents an item/ability build example. */
+/* Layout of a move example row with the current features, as written by WriteToCorpus (exported to the manifest). */
+func MoveColumns() []Column {
+	columns := []Column{
+		{"dotaTime", 1, "", "DotaTime() / time scale: time since the horn (negative before it, pauses don't count), 1 = 60 minutes by default"},
+		{"health", 1, "", "fraction of max health"},
+		{"mana", 1, "", "fraction of max mana"},
+		{"level", 1, "", "level / max level"},
+		{"creepFront", 1, "", "GetLaneFrontAmount() of the hero's team in the nearest lane"},
+		{"currentX", 1, "", "position, mapped to [0, 1]"},
+		{"currentY", 1, "", "position, mapped to [0, 1]"},
+		{"unitType", 1, "", "one of the Unit* constants, the kind of unit the order was given to"},
+	}
+
+	if features.Economy {
+		columns = append(columns,
+			Column{"reliableGold", 1, "", "reliable gold / gold scale"},
+			Column{"unreliableGold", 1, "", "unreliable gold / gold scale"},
+			Column{"netWorth", 1, "", "net worth / net worth scale"},
+		)
+	}
+
+	if features.Farm {
+		columns = append(columns,
+			Column{"lastHits", 1, "", "last hits / last hit scale"},
+			Column{"denies", 1, "", "denies / last hit scale"},
+		)
+	}
+
+	if features.Attributes {
+		columns = append(columns,
+			Column{"strength", 1, "", "strength (with bonuses) / attribute scale, 0 for units that aren't heroes"},
+			Column{"agility", 1, "", "agility (with bonuses) / attribute scale, 0 for units that aren't heroes"},
+			Column{"intelligence", 1, "", "intelligence (with bonuses) / attribute scale, 0 for units that aren't heroes"},
+		)
+	}
+
+	if features.Combat {
+		columns = append(columns,
+			Column{"damage", 1, "", "average attack damage plus bonus damage / damage scale"},
+			Column{"armor", 1, "", "armor / armor scale"},
+			Column{"moveSpeed", 1, "", "base move speed / move speed scale"},
+			Column{"attackRange", 1, "", "attack range / attack range scale"},
+		)
+	}
+
+	if features.Alive {
+		columns = append(columns, Column{"alive", 1, "", "1 if the unit is alive, 0 if it's dead"})
+	}
+
+	if features.FogOfWar {
+		columns = append(columns,
+			Column{"otherXY", 18, "", "x, y of the other 9 heroes mapped to [0, 1], allies in the first 4 slots then enemies, each ordered by player ID (last seen position, (0, 0) if never seen)"},
+			Column{"enemySinceSeen", 5, "", "how long ago each enemy was last seen by the hero's team, 0 if visible, 1 if a minute or more (or never)"},
+		)
+	} else {
+		columns = append(columns, Column{"otherXY", 18, "", "x, y of the other 9 heroes mapped to [0, 1], allies in the first 4 slots then enemies, each ordered by player ID"})
+	}
+
+	if features.HeroIdentities {
+		columns = append(columns, Column{"otherHeroes", 9, "heroes", "ID of the hero in each otherXY slot, 0 if the slot is empty"})
+	}
+
+	if features.NearestUnits > 0 {
+		columns = append(columns, Column{"nearestUnits", 6 * features.NearestUnits, "targets", "for each of the closest lane creeps, neutrals, towers and summons, closest first: 1 (0 for padding, with the rest 0 too), x, y relative to the unit in the [0, 1] mapping, fraction of max health, 1 if allied, kind of unit (one of the Target* constants)"})
+	}
+
+	if features.Modifiers {
+		columns = append(columns, Column{"modifiers", 10 * modifierColumns, "modifiers", "1 or 0 for each modifier in the modifiers vocabulary then 1 or 0 for channelling, on the unit then on the hero in each otherXY slot (all 0 for empty slots, and enemies that can't be seen with -fog)"})
+	}
+
+	return append(columns, moveOutputColumns...)
+}
+
+var moveOutputColumns []Column = []Column{
+	{"cooldowns", 0, "abilities", "one per ability in the abilities vocabulary, cooldown / cooldown scale (1 if not leveled)"},
+	{"items", 1, "", "the literal string items"},
+	{"inventory", USABLE_SLOTS * 4, "items", "for each inventory slot, then the TP scroll and neutral item slots: ID + 1 (0 if empty, or if the patch doesn't have the slot), usable right now (1 or 0), charges, cooldown / cooldown scale"},
+	{"backpack", 1, "", "the literal string backpack"},
+	{"backpackItems", 0, "items", "IDs of everything in the backpack"},
+	{"stash", 1, "", "the literal string stash"},
+	{"stashItems", 0, "items", "IDs of everything in the stash"},
+	{"output", 1, "", "the literal string output"},
+	{"isAttack", 1, "", "1 if the order was an attack or ability use"},
+	{"hasMove", 1, "", "1 if the order had a destination (moveX, moveY are 0 otherwise)"},
+	{"moveX", 1, "", "destination, mapped to [0, 1]"},
+	{"moveY", 1, "", "destination, mapped to [0, 1]"},
+	{"hasTargetPosition", 1, "", "1 if the order was aimed somewhere, at a position or an entity (targetX, targetY are 0 otherwise)"},
+	{"targetX", 1, "", "position of the target entity or the ground target, mapped to [0, 1]"},
+	{"targetY", 1, "", "position of the target entity or the ground target, mapped to [0, 1]"},
+	{"hasTarget", 1, "", "1 if the order was aimed at an entity: attacks and abilities, but also following, giving items and picking things up (target is 0 otherwise)"},
+	{"target", 1, "targets", "one of the Target* constants (index into targets, starting at 1), 0 if there's no target"},
+	{"abilityUsed", 1, "activeAbilities", "label (ID + 1), 1 if no ability was used"},
+	{"itemUsed", 1, "activeItems", "label (ID + 1), 1 if no item was used"},
+	{"orderType", 1, "orders", "label of the order type (one of the Order* constants + 1, index into orders)"},
+	{"queued", 1, "", "2 if the order was shift-queued, 1 otherwise"},
+}
+
+/* Represents an item build example (an item being bought). */
 type BuildExample struct {
+	DotaTime       float32
+	ReliableGold   float32
+	UnreliableGold float32
+	NetWorth       float32
+	Level          float32
+
+	Inventory   []string
+	Backpack    []string
+	Stash       []string
+	EnemyHeroes []string
+
+	ItemBought string
+}
+
+func (example *BuildExample) SetDotaTime(time float32) {
+	example.DotaTime = time
+}
+
+/* Writes a build example to CSV. */
+func (example *BuildExample) WriteToCorpus(corpus *Corpus) {
+	/* Input:
+	   current time, gold, net worth, XP level, what's in the inventory, backpack and stash, and the enemy heroes.
+	*/
+	corpus.Item.WriteString(fmt.Sprintf("%f,%f,%f,%f,%f,",
+		example.DotaTime,
+		example.ReliableGold,
+		example.UnreliableGold,
+		example.NetWorth,
+		example.Level,
+	))
+
+	corpus.Item.WriteString("items,")
+
+	for _, item := range example.Inventory {
+		corpus.Item.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedItems, item)))
+	}
+
+	corpus.Item.WriteString("backpack,")
+
+	for _, item := range example.Backpack {
+		corpus.Item.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedItems, item)))
+	}
+
+	corpus.Item.WriteString("stash,")
+
+	for _, item := range example.Stash {
+		corpus.Item.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedItems, item)))
+	}
+
+	corpus.Item.WriteString("enemies,")
+
+	for _, hero := range example.EnemyHeroes {
+		corpus.Item.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedEnemyHeroes, hero)))
+	}
+
+	/* Output:
+	   label of the item bought
+	*/
+	corpus.Item.WriteString("output,")
+
+	corpus.Item.WriteString(fmt.Sprintf("%d\n", ObserveLabel(corpus.ObservedItems, example.ItemBought)))
+}
+
+/* Layout of a build example row, as written by WriteToCorpus (exported to the manifest). */
+var buildColumns []Column = []Column{
+	{"dotaTime", 1, "", "DotaTime() / time scale: time since the horn (negative before it, pauses don't count), 1 = 60 minutes by default"},
+	{"reliableGold", 1, "", "reliable gold / gold scale"},
+	{"unreliableGold", 1, "", "unreliable gold / gold scale"},
+	{"netWorth", 1, "", "net worth / net worth scale"},
+	{"level", 1, "", "level / max level"},
+	{"items", 1, "", "the literal string items"},
+	{"inventory", 0, "items", "IDs of everything in the inventory"},
+	{"backpack", 1, "", "the literal string backpack"},
+	{"backpackItems", 0, "items", "IDs of everything in the backpack"},
+	{"stash", 1, "", "the literal string stash"},
+	{"stashItems", 0, "items", "IDs of everything in the stash"},
+	{"enemies", 1, "", "the literal string enemies"},
+	{"enemyHeroes", 0, "enemyHeroes", "IDs of the enemy heroes"},
+	{"output", 1, "", "the literal string output"},
+	{"itemBought", 1, "items", "label (ID + 1)"},
+}
+
+/* Represents a skill build example (a skill point being spent). */
+type SkillExample struct {
+	DotaTime float32
+	Level    float32
+
+	AbilityLevels []int32
+	Abilities     []string // names of the abilities the levels belong to
+	Talents       []string // talents already taken
+
+	AbilityLeveled string // ability or talent
+}
+
+func (example *SkillExample) SetDotaTime(time float32) {
+	example.DotaTime = time
 }
 
-/* Map and other game constants. */
-const MIN_X = -8288.0
-const MAX_X = 8288.0
+/* Writes a skill build example to CSV. */
+func (example *SkillExample) WriteToCorpus(corpus *Corpus) {
+	/* Input:
+	   current time, XP level, level of each ability and the talents taken so far.
+	*/
+	corpus.Skill.WriteString(fmt.Sprintf("%f,%f,", example.DotaTime, example.Level))
+
+	for _, level := range example.AbilityLevels {
+		corpus.Skill.WriteString(fmt.Sprintf("%d,", level))
+	}
+
+	for ability_id, name := range example.Abilities {
+		if len(corpus.ObservedAbilities) <= ability_id {
+			corpus.ObservedAbilities = append(corpus.ObservedAbilities, name)
+		}
+	}
 
-const MIN_Y = -8288.0
-const MAX_Y = 8288.0
+	corpus.Skill.WriteString("talents,")
+
+	for _, talent := range example.Talents {
+		corpus.Skill.WriteString(fmt.Sprintf("%d,", Observe(corpus.ObservedSkills, talent)))
+	}
+
+	/* Output:
+	   label of the ability or talent leveled
+	*/
+	corpus.Skill.WriteString("output,")
 
-const CELL_SIZE = 128.0
+	corpus.Skill.WriteString(fmt.Sprintf("%d\n", ObserveLabel(corpus.ObservedSkills, example.AbilityLeveled)))
+}
 
-const COOLDOWN_SCALE = 360.0
+/* Layout of a skill build example row, as written by WriteToCorpus (exported to the manifest). */
+var skillColumns []Column = []Column{
+	{"dotaTime", 1, "", "DotaTime() / time scale: time since the horn (negative before it, pauses don't count), 1 = 60 minutes by default"},
+	{"level", 1, "", "level / max level"},
+	{"abilityLevels", 0, "abilities", "one per ability in the abilities vocabulary, the level it's at (0 if not leveled)"},
+	{"talents", 1, "", "the literal string talents"},
+	{"talentsTaken", 0, "skills", "IDs of the talents taken so far"},
+	{"output", 1, "", "the literal string output"},
+	{"abilityLeveled", 1, "skills", "label (ID + 1) of the ability or talent leveled"},
+}
 
+/* Game constants (the ones that change between patches are in the profiles). */
 const HANDLE_MAGIC = (1 << 14) - 1
 
+/* Layout of m_hItems: the inventory, then the backpack, then the stash (then the TP scroll and neutral item slots, see Profile). */
+const INVENTORY_START = 0
+const BACKPACK_START = 6
+const STASH_START = 9
+const STASH_END = 15
+
 /* Useful classnames. */
 const TOWER = "CDOTA_BaseNPC_Tower"
 const LANE_CREEP = "CDOTA_BaseNPC_Creep_Lane"
 const JUNGLE_CREEP = "CDOTA_BaseNPC_Creep_Neutral"
 const ANCIENT = "CDOTA_BaseNPC_Fort"
+const GAME_RULES = "CDOTAGamerulesProxy"
 const RUNE = "CDOTA_Item_Rune"
+const RADIANT_DATA = "CDOTA_DataRadiant"
+const DIRE_DATA = "CDOTA_DataDire"
+
+/* Optional features, set from the command line. They change the layout of the corpora. */
+type Features struct {
+	FogOfWar       bool // only use enemy positions the hero's team can see, plus how long ago they were seen
+	HeroIdentities bool // which hero is in each of the other hero slots
+	Economy        bool // reliable and unreliable gold, net worth
+	Farm           bool // last hits and denies
+	Attributes     bool // strength, agility and intelligence
+	Combat         bool // attack damage, armor, move speed and attack range
+	Alive          bool // whether the unit is alive
+	Modifiers      bool // important modifiers and channelling on the unit and the other heroes
+	NearestUnits   int  // how many of the closest creeps, towers and summons to add (0 for none)
+}
 
 /* Misc data. */
+var features Features
 var teams []map[string]uint64 = []map[string]uint64{}
 var corpora map[string][]*Corpus = make(map[string][]*Corpus)
 
@@ -159,174 +643,354 @@ func IsAbility(ent *manta.PacketEntity) bool {
 	return ent.ClassName == "CDOTABaseAbility" || strings.HasPrefix(ent.ClassName, "CDOTA_Ability") && ent.ClassName != "CDOTA_Ability_AttributeBonus"
 }
 
-/* Linearly maps coordinate components to [0, 1]. */
-func RemapX(x float32) float32 {
-	return (x+MIN_X)/(MAX_X-MIN_X) + 1
+/*
+	Retrieves the Hammer name of an entity (name used by edicts, which Valve calls the classname).
+	This is different from what Manta calls the "classname" (entity.ClassName), which is literally the name of the C++ class.
+	(Isn't terminology just great).
+*/
+func GetHammerName(parser *manta.Parser, entity *manta.PacketEntity) string {
+	if name_index, ok := entity.FetchInt32("CEntityIdentity.m_nameStringableIndex"); ok {
+		if name, ok := parser.LookupStringByIndex("EntityNames", name_index); ok {
+			return name
+		}
+	}
+
+	return ""
 }
 
-func RemapY(y float32) float32 {
-	return (y+MIN_Y)/(MAX_Y-MIN_Y) + 1
+/* Returns the ID of a name in one of the observed vocabularies, assigning the next free ID if it hasn't been seen yet. */
+func Observe(observed map[string]int, name string) int {
+	if id, ok := observed[name]; ok {
+		return id
+	}
+
+	next_id := len(observed) + 1
+	observed[name] = next_id
+
+	return next_id
 }
 
-/*
-	Retrieves the location of an entity.
+/* Returns the names in one of the observed vocabularies, ordered by ID. */
+func SortedByID(observed map[string]int) []string {
+	names := make([]string, 0, len(observed))
+
+	for name := range observed {
+		names = append(names, name)
+	}
 
-	Unlike the standard m_vecOrigin netprop in most Source games, Dota 2 splits an entity's location up into two parts in replays:
+	sort.Slice(names, func(i, j int) bool {
+		return observed[names[i]] < observed[names[j]]
+	})
 
-	- m_cellX, m_cellY: This represents which "cell" a location is in, with the map split into 128x128 cells.
-	- m_offsetX, m_offsetY: This then represents the offset of an entity within the cell, relative to its lower left corner.
+	return names
+}
 
-	(The Dota 2 map is 16577 x 16577 with the origin at its center as of 7.02. Most current resources for this kind of thing are for 6.xx, be wary!)
-	This function takes those components and turns it into a regular Cartesian coordinate, since that's what the bot API uses.
+/*
+	Returns the players' own heroes ordered by player ID, so every hero keeps the same slot for the whole match
+	(Go randomizes map order, which would shuffle them around from one example to the next).
+	Only the hero each player picked (selected: player ID -> entindex) counts, so illusions, clones, hero-like summons (Beastmaster's
+	boar and hawk) and heroes whose pick isn't known yet never take a slot.
 */
-func GetLocation(ent *manta.PacketEntity) []float32 {
-	cellX, _ := ent.FetchUint64("CBodyComponentBaseAnimatingOverlay.m_cellX")
-	cellY, _ := ent.FetchUint64("CBodyComponentBaseAnimatingOverlay.m_cellY")
+func SortedHeroes(heroes map[int32]*Hero, selected map[int32]int32) []*Hero {
+	sorted := make([]*Hero, 0, len(heroes))
+
+	for _, hero := range heroes {
+		if picked, ok := selected[hero.PlayerID]; ok && picked == hero.Entindex {
+			sorted = append(sorted, hero)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].PlayerID != sorted[j].PlayerID {
+			return sorted[i].PlayerID < sorted[j].PlayerID
+		}
+
+		return sorted[i].Entindex < sorted[j].Entindex
+	})
+
+	return sorted
+}
+
+/* Returns the label for a name in one of the observed vocabularies (ID + 1, as 1 is reserved for nothing). */
+func ObserveLabel(observed map[string]int, name string) int {
+	if name == "" {
+		return 1
+	}
+
+	return Observe(observed, name) + 1
+}
 
-	offsetX, _ := ent.FetchFloat32("CBodyComponentBaseAnimatingOverlay.m_vecX")
-	offsetY, _ := ent.FetchFloat32("CBodyComponentBaseAnimatingOverlay.m_vecY")
+/* Retrieves the names of the items in slots [start, end) of m_hItems, skipping the item entity with the given index (0 for none). */
+func GetItems(parser *manta.Parser, entity *manta.PacketEntity, start int, end int, skip int32) []string {
+	items := []string{}
 
-	return []float32{
-		RemapX(float32(cellX)*CELL_SIZE - (MAX_X*2 + 1) + offsetX),
-		RemapY(float32(cellY)*CELL_SIZE - (MAX_Y*2 + 1) + offsetY),
+	for item_count := start; item_count < end; item_count++ {
+		if item_handle, ok := entity.FetchUint32(fmt.Sprintf("m_hItems.%04d", item_count)); ok {
+			if item, ok := parser.PacketEntities[int32(item_handle&HANDLE_MAGIC)]; ok && item.Index != skip {
+				if name := GetHammerName(parser, item); name != "" {
+					items = append(items, name)
+				}
+			}
+		} else {
+			break
+		}
 	}
+
+	return items
 }
 
 /*
-	Retrieves the Hammer name of an entity (name used by edicts, which Valve calls the classname).
-	This is different from what Manta calls the "classname" (entity.ClassName), which is literally the name of the C++ class.
-	(Isn't terminology just great).
+	Retrieves a field of a player's entry in their team's data.
+	A lot of player state (gold, net worth...) isn't networked on the hero, it lives in the CDOTA_DataRadiant/CDOTA_DataDire entity of the
+	player's team, indexed by their slot in the team.
 */
-func GetHammerName(parser *manta.Parser, entity *manta.PacketEntity) string {
-	if name_index, ok := entity.FetchInt32("CEntityIdentity.m_nameStringableIndex"); ok {
-		if name, ok := parser.LookupStringByIndex("EntityNames", name_index); ok {
-			return name
+func GetPlayerData(parser *manta.Parser, teamData map[uint64]int32, team uint64, id int32, field string) int32 {
+	if data, ok := parser.PacketEntities[teamData[team]]; ok {
+		value, _ := data.FetchInt32(fmt.Sprintf("m_vecDataTeam.%04d.%s", id%5, field))
+		return value
+	}
+
+	return 0
+}
+
+/* Retrieves the reliable and unreliable gold of a player. */
+func GetGold(parser *manta.Parser, teamData map[uint64]int32, team uint64, id int32) (int32, int32) {
+	return GetPlayerData(parser, teamData, team, id, "m_iReliableGold"), GetPlayerData(parser, teamData, team, id, "m_iUnreliableGold")
+}
+
+/*
+	Constructs a build example out of the current state of a hero (and their gold as of the last tick, see GoldHistory). The item bought is
+	left for the caller to fill in. skip is the entity of the item that was just bought, so that it doesn't count as already being owned.
+*/
+func NewBuildExample(parser *manta.Parser, entity *manta.PacketEntity, heroes map[int32]*Hero, selected map[int32]int32, teamData map[uint64]int32, gold *GoldHistory, skip int32) *BuildExample {
+	team, _ := entity.FetchUint64("m_iTeamNum")
+	id, _ := entity.FetchInt32("m_iPlayerID")
+	level, _ := entity.FetchInt32("m_iCurrentLevel")
+
+	example := &BuildExample{}
+
+	reliable, unreliable := gold.Lookup(parser, id)
+
+	profile := ActiveProfile(parser)
+
+	example.ReliableGold = float32(reliable) / profile.GoldScale
+	example.UnreliableGold = float32(unreliable) / profile.GoldScale
+	example.NetWorth = float32(GetPlayerData(parser, teamData, team, id, "m_iNetWorth")) / profile.NetWorthScale
+	example.Level = float32(level) / profile.MaxLevel
+
+	example.Inventory = GetItems(parser, entity, INVENTORY_START, BACKPACK_START, skip)
+	example.Backpack = GetItems(parser, entity, BACKPACK_START, STASH_START, skip)
+	example.Stash = GetItems(parser, entity, STASH_START, STASH_END, skip)
+
+	for _, hero := range SortedHeroes(heroes, selected) {
+		if hero.Team == team {
+			continue
+		}
+
+		if enemy, ok := parser.PacketEntities[hero.Entindex]; ok {
+			if name := GetHammerName(parser, enemy); name != "" {
+				example.EnemyHeroes = append(example.EnemyHeroes, name)
+			}
 		}
 	}
 
-	return ""
+	return example
 }
 
-/* Minimum index (for partial sorting players by kills in the first pass. No point in using a heap for just 3 elements) */
-func MinIndex(top map[int32]*TopPlayer) int32 {
-	best := int32(math.MaxInt32)
-	bestIndex := int32(0)
+/* Talents are abilities as well, but they're named special_bonus_* instead of after the hero. */
+func IsTalent(name string) bool {
+	return strings.HasPrefix(name, "special_bonus_")
+}
 
-	for i, player := range top {
-		if player.Kills < best {
-			best = player.Kills
-			bestIndex = i
+/* Constructs a skill build example out of the current state of a hero. The ability leveled is left for the caller to fill in. */
+func NewSkillExample(parser *manta.Parser, entity *manta.PacketEntity) *SkillExample {
+	level, _ := entity.FetchInt32("m_iCurrentLevel")
+	ability_prefix := strings.SplitN(GetHammerName(parser, entity), "dota_hero_", 2)[1]
+
+	example := &SkillExample{}
+	example.Level = float32(level) / ActiveProfile(parser).MaxLevel
+
+	for ability_count := 0; ; ability_count++ {
+		if ability_handle, ok := entity.FetchUint32(fmt.Sprintf("m_hAbilities.%04d", ability_count)); ok {
+			if ability, ok := parser.PacketEntities[int32(ability_handle&HANDLE_MAGIC)]; ok {
+				name := GetHammerName(parser, ability)
+				ability_level, _ := ability.FetchInt32("m_iLevel")
+
+				if strings.HasPrefix(name, ability_prefix) { // same abilities (in the same order) as the cooldowns in the move corpus
+					example.AbilityLevels = append(example.AbilityLevels, ability_level)
+					example.Abilities = append(example.Abilities, name)
+				} else if IsTalent(name) && ability_level > 0 {
+					example.Talents = append(example.Talents, name)
+				}
+			}
+		} else {
+			break
 		}
 	}
 
-	return bestIndex
+	return example
 }
 
 /* Opens a demo file. */
-func OpenDemo(demo_name string) *os.File {
+func OpenDemo(demo_name string) (*os.File, error) {
 	filehandle, err := os.Open(demo_name)
 
 	if err != nil {
-		log.Fatal("Can't open demo")
+		return nil, fmt.Errorf("can't open demo: %s", err)
 	}
 
-	return filehandle
+	return filehandle, nil
 }
 
 /* Creates a Manta parser instance. */
-func CreateParser(demo *os.File) *manta.Parser {
+func CreateParser(demo *os.File) (*manta.Parser, error) {
 	parser, err := manta.NewStreamParser(demo)
 
 	if err != nil {
-		log.Fatalf("Unable to create parser: %s\n", err)
+		return nil, fmt.Errorf("unable to create parser: %s", err)
 	}
 
-	return parser
+	return parser, nil
+}
+
+/* Closes whichever of the given files were actually opened (for cleaning up after an error). */
+func CloseOpened(files ...*os.File) {
+	for _, file := range files {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+/* Opens the corpus files of a hero for one team (2 for Radiant, 3 for Dire). */
+func OpenTeamCorpus(hero string, team uint64) (*Corpus, error) {
+	prefix := fmt.Sprintf("data/%s/%d_", hero, team)
+
+	move_file, move_err := OpenCorpusFile(prefix + "moveexamples")
+	items_file, item_err := OpenCorpusFile(prefix + "itemsexamples")
+	skills_file, skill_err := OpenCorpusFile(prefix + "skillexamples")
+
+	if move_err != nil || item_err != nil || skill_err != nil {
+		CloseOpened(move_file, items_file, skills_file)
+		return nil, fmt.Errorf("error creating corpus files for hero %s, team %d", hero, team)
+	}
+
+	corpus := &Corpus{
+		move_file,
+		items_file,
+		skills_file,
+		bufio.NewWriter(move_file),
+		bufio.NewWriter(items_file),
+		bufio.NewWriter(skills_file),
+		make(map[string]int),
+		[]string{},
+		make(map[string]int),
+		make(map[string]int),
+		make(map[string]int),
+		make(map[string]int),
+		make(map[string]int),
+	}
+
+	if vocabulary, ok := fixedVocabularies[hero][team]; ok {
+		corpus.LoadVocabulary(vocabulary)
+	}
+
+	return corpus, nil
 }
 
 /* Returns or creates new corpus files for the given hero. */
-func GetCorpus(hero string) []*Corpus {
+func GetCorpus(hero string) ([]*Corpus, error) {
 	if corpus, ok := corpora[hero]; ok {
-		return corpus
+		return corpus, nil
 	} else {
 		if err := os.Mkdir("data/"+hero, 493); err != nil && !os.IsExist(err) {
-			log.Fatal("Can't create data folder")
+			return nil, fmt.Errorf("can't create data folder for hero %s: %s", hero, err)
 		}
 
-		radiant_move_file, radiant_move_err := os.Create("data/" + hero + "/2_moveexamples")
-		radiant_items_file, radiant_item_err := os.Create("data/" + hero + "/2_itemsexamples")
+		radiant, err := OpenTeamCorpus(hero, 2)
 
-		if radiant_move_err != nil || radiant_item_err != nil {
-			log.Fatalf("Error creating corpus files for hero %s, team Radiant\n", hero)
+		if err != nil {
+			return nil, err
 		}
 
-		dire_move_file, dire_move_err := os.Create("data/" + hero + "/3_moveexamples")
-		dire_items_file, dire_item_err := os.Create("data/" + hero + "/3_itemsexamples")
+		dire, err := OpenTeamCorpus(hero, 3)
 
-		if dire_move_err != nil || dire_item_err != nil {
-			log.Fatalf("Error creating corpus files for hero %s, team Dire\n", hero)
+		if err != nil {
+			CloseOpened(radiant.MoveFile, radiant.ItemFile, radiant.SkillFile)
+			return nil, err
 		}
 
-		corpus := []*Corpus{
-			{
-				radiant_move_file,
-				radiant_items_file,
-				bufio.NewWriter(radiant_move_file),
-				bufio.NewWriter(radiant_items_file),
-				make(map[string]int),
-				[]string{},
-				make(map[string]int),
-				make(map[string]int),
-			},
-			{
-				dire_move_file,
-				dire_items_file,
-				bufio.NewWriter(dire_move_file),
-				bufio.NewWriter(dire_items_file),
-				make(map[string]int),
-				[]string{},
-				make(map[string]int),
-				make(map[string]int),
-			},
-		}
+		corpus := []*Corpus{radiant, dire}
 
 		corpora[hero] = corpus
-		return corpus
+		return corpus, nil
 	}
 }
 
-/* Closes all the opened corpora files and writes the final ability/items/team composition data. */
-func CloseCorpora() {
+/*
+	Closes all the opened corpora files and writes the final ability/items/team composition data (ability_data.lua and MANIFEST_FILE).
+	Everything gets flushed and closed even if something fails along the way, the first error is returned.
+*/
+func CloseCorpora() error {
+	var first_err error
+
+	check := func(err error) {
+		if err != nil && first_err == nil {
+			first_err = err
+		}
+	}
+
 	/* Write ability_data.lua */
 	activeAbilities := new(bytes.Buffer)
 	activeItems := new(bytes.Buffer)
 	items := new(bytes.Buffer)
 	abilities := new(bytes.Buffer)
+	skills := new(bytes.Buffer)
+	enemies := new(bytes.Buffer)
+	otherHeroes := new(bytes.Buffer)
 
 	activeAbilities.WriteString("activeAbilities = {") // start of table
 	activeItems.WriteString("activeItems = {")
 	items.WriteString("items = {")
 	abilities.WriteString("abilities = {")
+	skills.WriteString("skills = {")
+	enemies.WriteString("enemies = {")
+	otherHeroes.WriteString("heroes = {")
+
+	heroes := make([]string, 0, len(corpora))
+
+	for hero := range corpora {
+		heroes = append(heroes, hero)
+	}
 
-	for hero, corpus := range corpora {
+	sort.Strings(heroes)
+
+	for _, hero := range heroes {
+		corpus := corpora[hero]
 		entry := fmt.Sprintf("%s={nil, {", hero) // map hero to team to abilities/items
 
 		activeAbilities.WriteString(entry)
 		activeItems.WriteString(entry)
 		items.WriteString(entry)
 		abilities.WriteString(entry)
+		skills.WriteString(entry)
+		enemies.WriteString(entry)
+		otherHeroes.WriteString(entry)
 
 		for _, team := range corpus {
 			/* Add an entry for the id -> ability/item as well as ability/item -> id */
-			for ability, id := range team.ObservedActiveAbilities {
+			for _, ability := range SortedByID(team.ObservedActiveAbilities) {
+				id := team.ObservedActiveAbilities[ability]
 				activeAbilities.WriteString(fmt.Sprintf("[%d]=\"%s\",%s=%d,", id, ability, ability, id))
 			}
 
-			for item, id := range team.ObservedActiveItems {
+			for _, item := range SortedByID(team.ObservedActiveItems) {
+				id := team.ObservedActiveItems[item]
 				activeItems.WriteString(fmt.Sprintf("[%d]=\"%s\",%s=%d,", id, item, item, id))
 			}
 
-			for item, id := range team.ObservedItems {
+			for _, item := range SortedByID(team.ObservedItems) {
+				id := team.ObservedItems[item]
 				items.WriteString(fmt.Sprintf("[%d]=\"%s\",%s=%d,", id, item, item, id))
 			}
 
@@ -334,42 +998,95 @@ func CloseCorpora() {
 				abilities.WriteString(fmt.Sprintf("\"%s\",", ability))
 			}
 
+			for _, skill := range SortedByID(team.ObservedSkills) {
+				id := team.ObservedSkills[skill]
+				skills.WriteString(fmt.Sprintf("[%d]=\"%s\",%s=%d,", id, skill, skill, id))
+			}
+
+			for _, hero := range SortedByID(team.ObservedEnemyHeroes) {
+				id := team.ObservedEnemyHeroes[hero]
+				enemies.WriteString(fmt.Sprintf("[%d]=\"%s\",%s=%d,", id, hero, hero, id))
+			}
+
+			for _, hero := range SortedByID(team.ObservedHeroes) {
+				id := team.ObservedHeroes[hero]
+				otherHeroes.WriteString(fmt.Sprintf("[%d]=\"%s\",%s=%d,", id, hero, hero, id))
+			}
+
 			activeAbilities.WriteString("},{") // close the table for that team
 			activeItems.WriteString("},{")
 			items.WriteString("},{")
 			abilities.WriteString("},{")
+			skills.WriteString("},{")
+			enemies.WriteString("},{")
+			otherHeroes.WriteString("},{")
 
-			team.Move.Flush()
-			team.Item.Flush()
+			check(team.Move.Flush())
+			check(team.Item.Flush())
+			check(team.Skill.Flush())
 
-			team.MoveFile.Close()
-			team.ItemFile.Close()
+			check(team.MoveFile.Close())
+			check(team.ItemFile.Close())
+			check(team.SkillFile.Close())
 		}
 
 		activeAbilities.WriteString("}},") // close the table for that hero
 		activeItems.WriteString("}},")
 		items.WriteString("}},")
 		abilities.WriteString("}},")
+		skills.WriteString("}},")
+		enemies.WriteString("}},")
+		otherHeroes.WriteString("}},")
 	}
 
 	activeAbilities.WriteString("}\n")
 	activeItems.WriteString("}\n")
 	items.WriteString("}\n")
 	abilities.WriteString("}\n")
+	skills.WriteString("}\n")
+	enemies.WriteString("}\n")
+	otherHeroes.WriteString("}\n")
 
-	if observed_file, err := os.Create("ability_data.lua"); err == nil || os.IsExist(err) {
+	if observed_file, err := os.Create("ability_data.lua"); err == nil {
 		writer := bufio.NewWriter(observed_file)
 
-		defer observed_file.Close()
-		defer writer.Flush()
-
 		writer.WriteString("-- This is an automatically generated file. Do not modify.\n")
 		writer.WriteString("module(\"ability_data\", package.seeall)\n")
 
+		/* Target labels, the same for everyone */
+		writer.WriteString("targets = {")
+
+		for _, target := range targetNames {
+			writer.WriteString(fmt.Sprintf("\"%s\",", target))
+		}
+
+		writer.WriteString("}\n")
+
+		/* Order types, also the same for everyone */
+		writer.WriteString("orders = {")
+
+		for _, order := range orderNames {
+			writer.WriteString(fmt.Sprintf("\"%s\",", order))
+		}
+
+		writer.WriteString("}\n")
+
+		/* Modifiers, same format as the observed vocabularies */
+		writer.WriteString("modifiers = {")
+
+		for i, modifier := range modifierNames {
+			writer.WriteString(fmt.Sprintf("[%d]=\"%s\",%s=%d,", i+1, modifier, modifier, i+1))
+		}
+
+		writer.WriteString("}\n")
+
 		writer.WriteString(activeAbilities.String())
 		writer.WriteString(activeItems.String())
 		writer.WriteString(items.String())
 		writer.WriteString(abilities.String())
+		writer.WriteString(skills.String())
+		writer.WriteString(enemies.String())
+		writer.WriteString(otherHeroes.String())
 
 		/* Also write team data (which isn't per corpus which is why we're doing it down here) */
 		writer.WriteString("teams = {")
@@ -378,9 +1095,17 @@ func CloseCorpora() {
 			radiant := new(bytes.Buffer)
 			dire := new(bytes.Buffer)
 
-			for hero, team_num := range team {
-				if team_num == 2 {
-					radiant.WriteString(fmt.Sprintf("\"%s\",", hero))
+			names := make([]string, 0, len(team))
+
+			for hero := range team {
+				names = append(names, hero)
+			}
+
+			sort.Strings(names)
+
+			for _, hero := range names {
+				if team[hero] == 2 {
+					radiant.WriteString(fmt.Sprintf("\"%s\",", hero))
 				} else {
 					dire.WriteString(fmt.Sprintf("\"%s\",", hero))
 				}
@@ -394,27 +1119,48 @@ func CloseCorpora() {
 		}
 
 		writer.WriteString("}\n")
+
+		check(writer.Flush())
+		check(observed_file.Close())
 	} else {
-		log.Fatalf("Error creating ability_data.lua")
+		check(fmt.Errorf("error creating ability_data.lua: %s", err))
 	}
+
+	check(SaveManifest())
+
+	return first_err
 }
 
 /*
-	Retrieves the top 3 players on the winning team and also gets the start time of the match (horn) in ticks.
-*/
-func FirstPass(filehandle *os.File) (map[int32]*TopPlayer, uint32) {
-	parser := CreateParser(filehandle)
+	Registers the callbacks that gather the end of game stats of every player and the winning team.
+	The returned function puts them together once the demo has been parsed.
 
-	var startTime uint32
-	var winningTeam int32
+	The winner is taken from (in order of preference):
+	- the demo's file info (game_winner), written at the very end of the demo
+	- the game rules (m_nGameWinner), set when the game ends, including when a team GGs out
+	- whichever team's ancient is still alive at the end, which only works if the ancient actually died
+*/
+func WatchMatch(parser *manta.Parser) func() *Match {
+	var clock GameClock
+	var fileInfoWinner, gameRulesWinner, ancientWinner uint64
 
-	top3 := make(map[int32]*TopPlayer)
+	players := make([]*Player, 10)
 	teamComposition := make(map[string]uint64)
 
+	for i := range players {
+		players[i] = &Player{ID: int32(i), Team: uint64(i/5 + 2)} // player IDs 0-4 are Radiant, 5-9 are Dire
+	}
+
+	parser.Callbacks.OnCDemoFileInfo(func(msg *dota.CDemoFileInfo) error {
+		if winner := msg.GetGameInfo().GetDota().GetGameWinner(); winner == 2 || winner == 3 {
+			fileInfoWinner = uint64(winner)
+		}
+
+		return nil
+	})
+
 	parser.OnPacketEntity(func(ent *manta.PacketEntity, _ manta.EntityEventType) error {
-		if startTime == 0 && ent.ClassName == RUNE {
-			startTime = parser.Tick
-		} else if IsHero(ent) {
+		if IsHero(ent) {
 			name := GetHammerName(parser, ent)
 
 			if _, ok := teamComposition[name]; !ok {
@@ -422,62 +1168,212 @@ func FirstPass(filehandle *os.File) (map[int32]*TopPlayer, uint32) {
 					teamComposition[name] = team
 				}
 			}
+		} else if ent.ClassName == GAME_RULES {
+			clock.Update(ent)
+
+			if winner, ok := ent.FetchInt32("m_pGameRules.m_nGameWinner"); ok && (winner == 2 || winner == 3) {
+				gameRulesWinner = uint64(winner)
+			}
 		} else if ent.ClassName == ANCIENT {
 			if health, ok := ent.FetchInt32("m_iHealth"); ok && health <= 0 { // ancient dead?
 				if team, ok := ent.FetchUint64("m_iTeamNum"); ok {
-					winningTeam = int32(team) ^ 1 // get the enemy team of the team whose ancient just died (2 ^ 1 == 3, 3 ^ 1 == 2)
+					ancientWinner = team ^ 1 // get the enemy team of the team whose ancient just died (2 ^ 1 == 3, 3 ^ 1 == 2)
 				} else {
-					log.Fatalf("Error retrieving m_iTeamNum from ancient (tick %d)\n", parser.Tick)
+					return fmt.Errorf("error retrieving m_iTeamNum from ancient (tick %d)", parser.Tick)
 				}
 			}
-		} else if ent.ClassName == "CDOTA_PlayerResource" && winningTeam != 0 {
-			for i := (winningTeam - 2) * 5; i < (winningTeam-1)*5; i++ {
-				id := fmt.Sprintf("%04d", i)
-
-				if kills, ok := ent.FetchInt32("m_vecPlayerTeamData." + id + ".m_iKills"); ok { // kill count
-					if name, ok := ent.FetchString("m_vecPlayerData." + id + ".m_iszPlayerName"); ok { // name
-						if len(top3) < 3 {
-							top3[i] = &TopPlayer{kills, name}
-						} else {
-							min_index := MinIndex(top3)
-
-							if min_player, _ := top3[min_index]; min_player.Kills < kills { // higher than lowest top 3 player, replace
-								delete(top3, min_index)
-								top3[i] = &TopPlayer{kills, name}
-							}
-						}
-					}
+		} else if ent.ClassName == "CDOTA_PlayerResource" {
+			for _, player := range players {
+				id := fmt.Sprintf("%04d", player.ID)
+
+				if name, ok := ent.FetchString("m_vecPlayerData." + id + ".m_iszPlayerName"); ok {
+					player.Name = name
+				}
+
+				if steamID, ok := ent.FetchUint64("m_vecPlayerData." + id + ".m_iPlayerSteamID"); ok {
+					player.SteamID = steamID
+				}
+
+				if kills, ok := ent.FetchInt32("m_vecPlayerTeamData." + id + ".m_iKills"); ok {
+					player.Kills = kills
+				}
+
+				if deaths, ok := ent.FetchInt32("m_vecPlayerTeamData." + id + ".m_iDeaths"); ok {
+					player.Deaths = deaths
+				}
+
+				if assists, ok := ent.FetchInt32("m_vecPlayerTeamData." + id + ".m_iAssists"); ok {
+					player.Assists = assists
 				}
 			}
+		} else if ent.ClassName == RADIANT_DATA || ent.ClassName == DIRE_DATA {
+			minutes := clock.Minutes()
+
+			for _, player := range players {
+				if (ent.ClassName == RADIANT_DATA) != (player.Team == 2) {
+					continue
+				}
+
+				slot := fmt.Sprintf("m_vecDataTeam.%04d.", player.ID%5)
 
-			parser.Stop()
+				if lastHits, ok := ent.FetchInt32(slot + "m_iLastHitCount"); ok {
+					player.LastHits = lastHits
+				}
+
+				if heroDamage, ok := ent.FetchInt32(slot + "m_iHeroDamage"); ok {
+					player.HeroDamage = heroDamage
+				}
+
+				if minutes > 0 {
+					if gold, ok := ent.FetchInt32(slot + "m_iTotalEarnedGold"); ok {
+						player.GPM = float32(gold) / minutes
+					}
+
+					if xp, ok := ent.FetchInt32(slot + "m_iTotalEarnedXP"); ok {
+						player.XPM = float32(xp) / minutes
+					}
+				}
+			}
 		}
 
 		return nil
 	})
 
-	parser.Start()
+	return func() *Match {
+		match := &Match{players, teamComposition, 0, "unknown"}
 
-	teams = append(teams, teamComposition)
+		if fileInfoWinner != 0 {
+			match.WinningTeam, match.WinnerFrom = fileInfoWinner, "file info"
+		} else if gameRulesWinner != 0 {
+			match.WinningTeam, match.WinnerFrom = gameRulesWinner, "game rules"
+		} else if ancientWinner != 0 {
+			match.WinningTeam, match.WinnerFrom = ancientWinner, "ancient"
+		}
 
-	return top3, startTime
+		return match
+	}
+}
+
+/* Retrieves the end of game stats, winner and start time of a match. */
+func FirstPass(filehandle *os.File) (*Match, error) {
+	parser, err := CreateParser(filehandle)
+
+	if err != nil {
+		return nil, err
+	}
+
+	finish := WatchMatch(parser)
+
+	if err := parser.Start(); err != nil {
+		return nil, err
+	}
+
+	return finish(), nil
 }
 
 /*
-	Tracks the actions of the top 3 players on the winning team and constructs examples out of each action.
+	Registers the callbacks that track the actions of the players passing the filter and construct examples out of each action.
+	Movement/attacks/casts go to the move corpus, item purchases to the build corpus and skill points to the skill build corpus.
+	The returned function gives back the examples once the demo has been parsed (they aren't written straight away, see CommitDemo).
 */
-func SecondPass(filehandle *os.File, top3 map[int32]*TopPlayer, startTime float32) {
-	parser := CreateParser(filehandle)
+func WatchActions(parser *manta.Parser, filter func(id int32) bool) func() []*PendingExample {
+	examples := []*PendingExample{}
+
+	heroes := make(map[int32]*Hero)   // entindex -> hero, including illusions and clones
+	selected := make(map[int32]int32) // player ID -> entindex of the hero they picked
+	teamData := make(map[uint64]int32)
+	laneCreeps := make(map[int32]uint64)
+	sightings := NewSightings()
+	destroyed := NewDestroyedEntities()
+	modifiers := WatchModifiers(parser)
+	purchases := NewPurchases()
+	gold := NewGoldHistory()
+
+	var clock GameClock
+
+	/* Queues up an example, stamped with the game time. Anything that happens while the game is paused (or before the pre-game) is left out. */
+	emit := func(hero string, team uint64, id int32, example Example) {
+		if time, ok := clock.DotaTime(); ok && !clock.Paused {
+			example.SetDotaTime(time / ActiveProfile(parser).TimeScale)
+			examples = append(examples, &PendingExample{hero, team, id, parser.Tick, example})
+		}
+	}
 
-	heroes := make(map[string]*Hero)
-	//creep_front := [2]float32{
+	parser.OnPacketEntity(func(ent *manta.PacketEntity, event manta.EntityEventType) error {
+		if event == manta.EntityEventType_Delete {
+			destroyed.Add(parser, ent)
+			delete(modifiers, ent.Index) // the entindex can get reused
+		}
 
-	parser.OnPacketEntity(func(ent *manta.PacketEntity, _ manta.EntityEventType) error {
 		if IsHero(ent) {
-			if _, ok := heroes[ent.ClassName]; !ok {
+			if event == manta.EntityEventType_Delete {
+				delete(heroes, ent.Index)
+				return nil
+			}
+
+			hero, ok := heroes[ent.Index]
+
+			if !ok {
 				team, _ := ent.FetchUint64("m_iTeamNum")
 
-				heroes[ent.ClassName] = &Hero{team, ent.Index}
+				hero = &Hero{team, ent.Index, -1, false, false}
+				heroes[ent.Index] = hero
+			}
+
+			if id, ok := ent.FetchInt32("m_iPlayerID"); ok {
+				hero.PlayerID = id
+			}
+
+			hero.Illusion = IsIllusion(ent)
+
+			if picked, ok := selected[hero.PlayerID]; ok {
+				hero.Clone = !hero.Illusion && picked != ent.Index
+			}
+
+			if features.FogOfWar {
+				sightings.Update(parser, ent)
+			}
+		} else if ent.ClassName == "CDOTA_PlayerResource" {
+			for id := int32(0); id < 10; id++ {
+				if hero_handle, ok := ent.FetchUint32(fmt.Sprintf("m_vecPlayerTeamData.%04d.m_hSelectedHero", id)); ok && hero_handle&HANDLE_MAGIC != HANDLE_MAGIC {
+					selected[id] = int32(hero_handle & HANDLE_MAGIC)
+				}
+			}
+		} else if ent.ClassName == GAME_RULES {
+			clock.Update(ent)
+		} else if ent.ClassName == RADIANT_DATA {
+			teamData[2] = ent.Index
+			gold.Update(parser, ent, 2)
+		} else if ent.ClassName == DIRE_DATA {
+			teamData[3] = ent.Index
+			gold.Update(parser, ent, 3)
+		} else if ent.ClassName == LANE_CREEP {
+			if event == manta.EntityEventType_Delete {
+				delete(laneCreeps, ent.Index)
+			} else if team, ok := ent.FetchUint64("m_iTeamNum"); ok {
+				laneCreeps[ent.Index] = team
+			}
+		} else if IsItem(ent) && event == manta.EntityEventType_Create {
+			/* New item: if it's for a tracked player's own hero (not an illusion or clone), it might be what a purchase order bought */
+			if purchaser_handle, ok := ent.FetchUint32("m_hPurchaser"); ok {
+				purchaser_index := int32(purchaser_handle & HANDLE_MAGIC)
+
+				if purchaser, ok := parser.PacketEntities[purchaser_index]; ok && IsHero(purchaser) {
+					id, ok := purchaser.FetchInt32("m_iPlayerID")
+
+					if ok && filter(id) && selected[id] == purchaser_index {
+						if item := GetHammerName(parser, ent); item != "" {
+							team, _ := purchaser.FetchUint64("m_iTeamNum")
+
+							example := NewBuildExample(parser, purchaser, heroes, selected, teamData, gold, ent.Index)
+							example.ItemBought = item
+
+							if bought := purchases.Item(parser, id, &BoughtItem{parser.Tick, GetHammerName(parser, purchaser), team, example}); bought != nil {
+								emit(bought.Hero, bought.Team, id, bought.Example)
+							}
+						}
+					}
+				}
 			}
 		}
 
@@ -491,112 +1387,111 @@ func SecondPass(filehandle *os.File, top3 map[int32]*TopPlayer, startTime float3
 				entity := parser.PacketEntities[unit]
 
 				if entity != nil {
-					if IsHero(entity) { // replace with any criterion for producing examples
-						id, ok := entity.FetchInt32("m_iPlayerID")
+					if owner, unit_type := ResolveUnit(parser, heroes, entity); owner != nil { // replace with any criterion for producing examples
+						id, ok := owner.FetchInt32("m_iPlayerID")
 
-						if _, is_top3 := top3[id]; ok && is_top3 {
-							/* Construct feature vector. */
-							name := GetHammerName(parser, entity)
+						if ok && filter(id) {
+							/* Construct feature vector (out of the unit that was given the order, but in the corpus of the hero that owns it). */
+							name := GetHammerName(parser, owner)
 
-							team, _ := entity.FetchUint64("m_iTeamNum")
-							corpus := GetCorpus(name)[team-2]
+							team, _ := owner.FetchUint64("m_iTeamNum")
 							ability_prefix := strings.SplitN(name, "dota_hero_", 2)[1]
 
-							example := &MoveExample{}
-
 							target := msg.GetTargetIndex()
 							ability := msg.GetAbilityIndex()
 
-							coords := GetLocation(entity)
+							order_type := int(msg.GetOrderType())
 
-							// Targeted ability or attack
+							// Skill point spent, goes in the skill build corpus instead
+							if order_type == OrderTrainAbility {
+								if ability_ent, ok := parser.PacketEntities[ability]; ok {
+									if skill := GetHammerName(parser, ability_ent); skill != "" {
+										example := NewSkillExample(parser, owner)
+										example.AbilityLeveled = skill
+
+										emit(name, team, id, example)
+									}
+								}
+
+								continue
+							}
+
+							// Purchases go in the build corpus, once the item they bought shows up (the order only has the item's ID, not its name)
+							if order_type == OrderPurchaseItem {
+								if bought := purchases.Order(parser, id); bought != nil {
+									emit(bought.Hero, bought.Team, id, bought.Example)
+								}
+
+								break // one purchase, no matter how many units were selected
+							}
+
+							profile := ActiveProfile(parser)
+
+							example := &MoveExample{}
+							example.OrderType = order_type
+							example.Queued = msg.GetQueue()
+
+							coords := profile.GetLocation(entity)
+
+							// Targeted order (attacks and abilities, but also following units, giving items, picking up items and runes...)
 							if target != 0 {
-								example.IsAttack = 1.0
+								if order_type == OrderAttackTarget || IsCastOrder(order_type) {
+									example.IsAttack = 1.0
+								}
+
+								example.HasTargetEntity = 1.0
+								example.HasTargetPos = 1.0
 
 								if target == unit {
 									example.Target = TargetSelf
-									example.MoveX = coords[0]
-									example.MoveY = coords[1]
+									example.TargetX = coords[0]
+									example.TargetY = coords[1]
+								} else if order_type == OrderCastTargetTree {
+									// The target is a map tree ID, not an entindex, so don't look it up (it'd find some unrelated entity)
+									example.Target = TargetTree
+									example.HasTargetPos = 0.0 // filled in from the order's position, see below
 								} else if target_ent, ok := parser.PacketEntities[target]; ok {
-									target_coords := GetLocation(target_ent)
-									example.MoveX = target_coords[0]
-									example.MoveY = target_coords[1]
+									target_coords := profile.GetLocation(target_ent)
+									example.TargetX = target_coords[0]
+									example.TargetY = target_coords[1]
 
-									if IsHero(target_ent) {
-										target_team, _ := target_ent.FetchUint64("m_iTeamNum")
+									example.Target = ClassifyTarget(parser, target_ent, team)
 
-										if target_team == team {
-											example.Target = TargetFriendlyHero
-										} else {
-											example.Target = TargetEnemyHero
-										}
-									} else {
-										switch target_ent.ClassName {
-										case LANE_CREEP:
-											if ability == 0 {
-												continue
-											} else {
-												example.Target = TargetLane
-											}
+									if example.Target == TargetLane && ability == 0 {
+										continue
+									}
+								} else if target_info, ok := destroyed.Lookup(parser, target); ok {
+									// Manta corner case: packet entities are updated before callbacks so destroyed entities (eaten trees, picked up runes) are gone by this point
+									example.TargetX = target_info.X
+									example.TargetY = target_info.Y
 
-										case JUNGLE_CREEP:
-											example.Target = TargetJungle
-										case TOWER:
-											example.Target = TargetTower
-										default:
-											example.Target = TargetBuilding
-										}
+									example.Target = target_info.Classify(team)
+
+									if example.Target == TargetLane && ability == 0 {
+										continue
 									}
 								} else {
-									// Manta corner case: packet entities are updated before callbacks so destroyed entities (eaten trees, picked up runes) are gone by this point
+									// Not an entity at all, map trees don't get one (targeted by an order other than OrderCastTargetTree, e.g. attacking a tree)
 									//log.Fatalf("Error retrieving an attack target (entindex %d, tick %d, player %v)\n", target, parser.Tick, entity)
-									example.Target = TargetTree // assume tree was eaten for now
-									example.MoveX = coords[0]
-									example.MoveY = coords[1]
+									example.Target = TargetTree
+									example.HasTargetPos = 0.0 // unless the order says where it is, see below
 								}
 							}
 
-							example.AbilityUsed = 1
-							example.ItemUsed = 1
-
 							// Ability used (not necessarily targeted)
-							if ability != 0 {
+							if ability != 0 && IsCastOrder(order_type) {
 								example.IsAttack = 1.0
 
-								if target == 0 { // CWorld (self or location)
-									example.Target = TargetSelf
-									example.MoveX = coords[0]
-									example.MoveY = coords[1]
-								}
-
 								if ability_ent, ok := parser.PacketEntities[ability]; ok {
 									if IsItem(ability_ent) { // item
-										if name := GetHammerName(parser, ability_ent); name != "" {
-											if id, ok := corpus.ObservedActiveItems[name]; ok {
-												example.ItemUsed = id + 1
-											} else {
-												/* New item, increase observed item count and assign ID */
-												next_id := len(corpus.ObservedActiveItems) + 1
-
-												corpus.ObservedActiveItems[name] = next_id
-												example.ItemUsed = next_id + 1
-											}
-										}
+										example.ItemUsed = GetHammerName(parser, ability_ent)
 									} else if IsAbility(ability_ent) { // ability
 										if name := GetHammerName(parser, ability_ent); strings.HasPrefix(name, ability_prefix) {
-											if id, ok := corpus.ObservedActiveAbilities[name]; ok {
-												example.AbilityUsed = id + 1
-											} else {
-												/* New ability, increase observed ability count and assign ID */
-												next_id := len(corpus.ObservedActiveAbilities) + 1
-
-												corpus.ObservedActiveAbilities[name] = next_id
-												example.AbilityUsed = next_id + 1
-											}
+											example.AbilityUsed = name
 										}
 									}
 								} else {
-									// Could be caused by leveling an ability? Silence for now
+									// Ability is gone already (skill points are handled above), nothing to label
 									//log.Fatalf("Error retrieving an ability (entindex %d, tick %d, player %v)\n", ability, parser.Tick, entity)
 									continue
 								}
@@ -609,41 +1504,68 @@ func SecondPass(filehandle *os.File, top3 map[int32]*TopPlayer, startTime float3
 							level, _ := entity.FetchInt32("m_iCurrentLevel")
 
 							move_pos := msg.GetPosition()
+							world_coords := profile.GetWorldLocation(entity)
 
-							example.DotaTime = (float32(parser.Tick) - startTime) / 108000.0 // DotaTime()
-							example.Health = float32(health) / float32(maxHealth)            // :GetHealth()
-							example.Mana = mana / maxMana                                    // :GetMana()
-							example.Level = float32(level) / 25.0                            // :GetCurrentLevel()
-							example.CreepFront = 0.0                                         // GetLaneFrontAmount() FIXME
+							example.Health = float32(health) / float32(maxHealth) // :GetHealth()
+							example.Mana = mana / maxMana                         // :GetMana()
+							example.Level = float32(level) / profile.MaxLevel     // :GetCurrentLevel()
+							example.CreepFront = GetLaneFrontAmount(parser, laneCreeps, team, profile.NearestLane(world_coords[0], world_coords[1]))
 
 							// my position
 							example.CurrentX = coords[0]
 							example.CurrentY = coords[1]
+							example.UnitType = unit_type
+							example.State = GetHeroState(parser, entity, teamData, team, id)
+							example.Modifiers[0] = modifiers.Active(parser, entity)
+
+							if features.NearestUnits > 0 {
+								example.NearestUnits = GetNearestUnits(parser, entity, team, features.NearestUnits)
+							}
 
 							// everyone else's position
 							ally := 0
 							enemy := 4
 
-							for _, hero := range heroes {
-								if hero.Entindex == entity.Index {
+							for _, hero := range SortedHeroes(heroes, selected) {
+								if hero.PlayerID == id { // that's us (or whoever owns the unit)
 									continue
 								}
 
-								loc := GetLocation(parser.PacketEntities[hero.Entindex])
+								other := parser.PacketEntities[hero.Entindex]
+
+								if (hero.Team == team && ally >= 4) || (hero.Team != team && enemy >= 9) { // more heroes than slots (shouldn't happen, but don't lose the demo over it)
+									continue
+								}
 
 								if hero.Team == team {
+									loc := profile.GetLocation(other)
+
 									example.OtherX[ally] = loc[0]
 									example.OtherY[ally] = loc[1]
+									example.OtherHeroes[ally] = GetHammerName(parser, other)
+									example.Modifiers[ally+1] = modifiers.Active(parser, other)
 									ally++
+								} else if features.FogOfWar { // only what the team can see
+									example.OtherX[enemy], example.OtherY[enemy], example.EnemySinceSeen[enemy-4] = sightings.Lookup(parser, other, team)
+									example.OtherHeroes[enemy] = GetHammerName(parser, other)
+
+									if IsVisibleTo(other, team) {
+										example.Modifiers[enemy+1] = modifiers.Active(parser, other)
+									}
+
+									enemy++
 								} else {
+									loc := profile.GetLocation(other)
+
 									example.OtherX[enemy] = loc[0]
 									example.OtherY[enemy] = loc[1]
+									example.OtherHeroes[enemy] = GetHammerName(parser, other)
+									example.Modifiers[enemy+1] = modifiers.Active(parser, other)
 									enemy++
 								}
 							}
 
 							// Retrieve ability cooldowns
-							ability_id := 0
 							for ability_count := 0; ; ability_count++ {
 								if ability_handle, ok := entity.FetchUint32(fmt.Sprintf("m_hAbilities.%04d", ability_count)); ok {
 									if ability, ok := parser.PacketEntities[int32(ability_handle&HANDLE_MAGIC)]; ok {
@@ -651,14 +1573,10 @@ func SecondPass(filehandle *os.File, top3 map[int32]*TopPlayer, startTime float3
 											if level, ok := ability.FetchInt32("m_iLevel"); level == 0 || !ok {
 												example.AbilityCooldowns = append(example.AbilityCooldowns, 1.0)
 											} else if cooldown, ok := ability.FetchFloat32("m_fCooldown"); ok {
-												example.AbilityCooldowns = append(example.AbilityCooldowns, cooldown/360)
-											}
-
-											if len(corpus.ObservedAbilities) <= ability_id {
-												corpus.ObservedAbilities = append(corpus.ObservedAbilities, name)
+												example.AbilityCooldowns = append(example.AbilityCooldowns, cooldown/profile.CooldownScale)
 											}
 
-											ability_id++
+											example.Abilities = append(example.Abilities, name)
 										}
 									}
 								} else {
@@ -667,31 +1585,25 @@ func SecondPass(filehandle *os.File, top3 map[int32]*TopPlayer, startTime float3
 							}
 
 							// Retrieve current items
-							for item_count := 0; ; item_count++ {
-								if item_handle, ok := entity.FetchUint32(fmt.Sprintf("m_hItems.%04d", item_count)); ok {
-									if item, ok := parser.PacketEntities[int32(item_handle&HANDLE_MAGIC)]; ok {
-										if name := GetHammerName(parser, item); name != "" {
-											if id, ok := corpus.ObservedItems[name]; ok {
-												example.CurrentItems = append(example.CurrentItems, id)
-											} else {
-												next_id := len(corpus.ObservedItems) + 1
-
-												corpus.ObservedItems[name] = next_id
-												example.CurrentItems = append(example.CurrentItems, next_id)
-											}
-										}
-									}
-								} else {
-									break
-								}
-							}
+							example.Inventory = GetItemSlots(parser, entity)
+							example.Backpack = GetItems(parser, entity, BACKPACK_START, STASH_START, 0)
+							example.Stash = GetItems(parser, entity, STASH_START, STASH_END, 0)
 
 							if move_pos != nil {
-								example.MoveX = RemapX(move_pos.GetX())
-								example.MoveY = RemapY(move_pos.GetY())
+								switch order_type {
+								case OrderMoveToPosition, OrderMoveToDirection, OrderAttackMove, OrderPatrol:
+									example.HasMove = 1.0
+									example.MoveX = profile.RemapX(move_pos.GetX())
+									example.MoveY = profile.RemapY(move_pos.GetY())
+
+								case OrderCastPosition, OrderVectorTargetPosition, OrderCastTargetTree:
+									example.HasTargetPos = 1.0
+									example.TargetX = profile.RemapX(move_pos.GetX())
+									example.TargetY = profile.RemapY(move_pos.GetY())
+								}
 							}
 
-							example.WriteToCorpus(corpus)
+							emit(name, team, id, example)
 						}
 					}
 				}
@@ -701,36 +1613,323 @@ func SecondPass(filehandle *os.File, top3 map[int32]*TopPlayer, startTime float3
 		return nil
 	})
 
-	parser.Start()
+	return func() []*PendingExample {
+		return examples
+	}
 }
 
-func main() {
-	defer CloseCorpora()
+/* Makes examples out of the actions of the selected players. */
+func SecondPass(filehandle *os.File, tracked map[int32]*Player) ([]*PendingExample, error) {
+	parser, err := CreateParser(filehandle)
+
+	if err != nil {
+		return nil, err
+	}
+
+	finish := WatchActions(parser, func(id int32) bool {
+		_, is_tracked := tracked[id]
+		return is_tracked
+	})
+
+	if err := parser.Start(); err != nil {
+		return nil, err
+	}
+
+	return finish(), nil
+}
+
+/*
+	Does both passes at once: makes examples out of everyone's actions while gathering the match info.
+	Which players to keep the examples of can only be decided once the whole demo has been parsed, see KeepTracked.
+*/
+func SinglePass(filehandle *os.File) (*Match, []*PendingExample, error) {
+	parser, err := CreateParser(filehandle)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	finishMatch := WatchMatch(parser)
+	finishActions := WatchActions(parser, func(int32) bool {
+		return true
+	})
+
+	if err := parser.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	return finishMatch(), finishActions(), nil
+}
+
+/* Drops the examples of players that weren't selected. */
+func KeepTracked(examples []*PendingExample, tracked map[int32]*Player) []*PendingExample {
+	kept := []*PendingExample{}
+
+	for _, pending := range examples {
+		if _, is_tracked := tracked[pending.PlayerID]; is_tracked {
+			kept = append(kept, pending)
+		}
+	}
+
+	return kept
+}
+
+/*
+	Parses a demo, returning the examples made out of the selected players' actions. Safe to call on several demos at once.
+	With singlePass, the demo only gets parsed once but everyone's examples have to be held onto until the end.
+	If anything goes wrong (including Manta panicking on a corrupt demo), the demo comes back with Err set and no examples.
+*/
+func ParseDemo(index int, demo_name string, selector PlayerSelector, singlePass bool) (demo *ParsedDemo) {
+	demo = &ParsedDemo{Index: index, Name: demo_name}
+
+	defer func() {
+		if r := recover(); r != nil {
+			demo.Match, demo.Examples, demo.Err = nil, nil, fmt.Errorf("parser panicked: %v", r)
+		}
+	}()
+
+	log.Printf("Demo %d (%s)\n", index+1, demo_name)
+
+	filehandle, err := OpenDemo(demo_name)
+
+	if err != nil {
+		demo.Err = err
+		return
+	}
+
+	defer filehandle.Close()
+
+	var match *Match
+	var examples []*PendingExample
+
+	if singlePass {
+		match, examples, err = SinglePass(filehandle)
+	} else {
+		match, err = FirstPass(filehandle) // retrieve end of game stats
+	}
+
+	if err != nil {
+		demo.Err = err
+		return
+	}
+
+	if match.WinningTeam == 0 {
+		log.Printf("Demo %d: couldn't find the winner, selections that depend on it will be empty\n", index+1)
+	} else {
+		log.Printf("Demo %d: winner is team %d (from %s)\n", index+1, match.WinningTeam, match.WinnerFrom)
+	}
+
+	tracked := selector.Select(match.Players, match.WinningTeam)
+
+	for id, player := range tracked {
+		log.Println(index+1, id, player.Name, player.SteamID, player.Kills, player.Deaths, player.Assists)
+	}
+
+	if singlePass {
+		examples = KeepTracked(examples, tracked)
+	} else {
+		filehandle.Seek(0, 0) // go back to beginning of demo
+
+		if examples, err = SecondPass(filehandle, tracked); err != nil { // make examples
+			demo.Err = err
+			return
+		}
+	}
+
+	demo.Match, demo.Examples = match, examples
 
+	return
+}
+
+/*
+	Writes a parsed demo's team composition and examples to the corpora.
+	This is the only thing that touches the corpora while demos are being parsed. It's only ever called from one goroutine, in demo order,
+	so IDs get handed out the same way no matter how many demos are parsed at once or which one finishes first.
+	All the corpus files the demo needs are opened before anything is written, so a failure doesn't leave half a demo in the corpora.
+*/
+func CommitDemo(demo *ParsedDemo) error {
+	for _, pending := range demo.Examples {
+		if _, err := GetCorpus(pending.Hero); err != nil {
+			return err
+		}
+	}
+
+	teams = append(teams, demo.Match.Teams)
+
+	for _, pending := range demo.Examples {
+		pending.Example.WriteToCorpus(corpora[pending.Hero][pending.Team-2])
+	}
+
+	return nil
+}
+
+/* Writes the list of demos that were skipped and why, one per line. */
+func WriteFailureReport(failures []*ParsedDemo) error {
+	report, err := os.Create("failed_demos.txt")
+
+	if err != nil {
+		return fmt.Errorf("error creating failed_demos.txt: %s", err)
+	}
+
+	writer := bufio.NewWriter(report)
+
+	for _, demo := range failures {
+		writer.WriteString(fmt.Sprintf("%s\t%s\n", demo.Name, demo.Err))
+	}
+
+	if err := writer.Flush(); err != nil {
+		report.Close()
+		return err
+	}
+
+	return report.Close()
+}
+
+func main() {
 	log.SetOutput(os.Stdout)
 
+	policy := flag.String("players", "top", "whose actions to make examples out of: all, winners, top or steamids")
+	topN := flag.Int("top", 3, "number of players to select with -players top")
+	topBy := flag.String("by", "kills", "stat to rank players by with -players top: kills, kda, gpm, xpm, lasthits or herodamage")
+	winnersOnly := flag.Bool("winners-only", true, "only rank players on the winning team with -players top")
+	steamIDs := flag.String("steamids", "", "comma separated Steam IDs to select with -players steamids")
+	jobs := flag.Int("j", 1, "number of demos to parse at once")
+	flag.BoolVar(&features.FogOfWar, "fog", false, "only use enemy positions the hero's team can see (last seen positions otherwise), plus how long ago each enemy was seen")
+	flag.BoolVar(&features.HeroIdentities, "hero-ids", false, "add which hero is in each of the other hero slots")
+	flag.BoolVar(&features.Economy, "economy", false, "add reliable and unreliable gold and net worth")
+	flag.BoolVar(&features.Farm, "farm", false, "add last hits and denies")
+	flag.BoolVar(&features.Attributes, "attributes", false, "add strength, agility and intelligence")
+	flag.BoolVar(&features.Combat, "combat", false, "add attack damage, armor, move speed and attack range")
+	flag.BoolVar(&features.Alive, "alive", false, "add whether the unit is alive")
+	flag.BoolVar(&features.Modifiers, "modifiers", false, "add which important modifiers (stuns, silences, invisibility...) are on the unit and the other heroes, and whether they're channelling")
+	flag.IntVar(&features.NearestUnits, "nearest", 0, "add the position, health, team and kind of the N closest creeps, towers and summons")
+	singlePass := flag.Bool("single-pass", false, "parse each demo once instead of twice, at the cost of holding everyone's examples in memory")
+	flag.BoolVar(&appendCorpora, "append", false, "append to the corpora and vocabularies of a previous run instead of starting over")
+	profileFile := flag.String("profiles", "", "JSON file with map bounds and feature scales for newer patches, see profiles.go")
+	vocabFile := flag.String("vocab", "", "hand out IDs from the vocabularies in this "+MANIFEST_FILE+" (names it doesn't have get the next free IDs), instead of in the order names show up")
+
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		log.Fatal("usage: corpus_build [options] <demos...>")
+	}
+
+	/*
+		Demos are always committed in sorted order, so the same set of demos hands out the same IDs and writes the same corpora.
+		IDs still depend on which demos come first, though (adding or renaming one can shuffle them), use -vocab to pin them down.
+	*/
+	demo_names := append([]string{}, flag.Args()...)
+	sort.Strings(demo_names)
+
+	if *jobs < 1 {
+		log.Fatal("-j needs to be at least 1")
+	}
+
+	if features.NearestUnits < 0 {
+		log.Fatal("-nearest can't be negative")
+	}
+
+	selector, err := NewPlayerSelector(*policy, *topN, *topBy, *winnersOnly, *steamIDs)
+
+	if err != nil {
+		log.Fatalf("Bad player selection: %s\n", err)
+	}
+
+	if *profileFile != "" {
+		if err := LoadProfiles(*profileFile); err != nil {
+			log.Fatalf("Can't load the patch profiles: %s\n", err)
+		}
+	}
+
 	if err := os.Mkdir("data", 493); err != nil && !os.IsExist(err) {
 		log.Fatal("Can't create data folder")
 	}
 
-	if len(os.Args) == 1 {
-		log.Fatal("usage: corpus_build <demos...>")
+	if *vocabFile != "" {
+		if appendCorpora {
+			log.Fatal("-vocab can't be used with -append (which already keeps the previous run's IDs)")
+		}
+
+		if err := LoadVocabularies(*vocabFile); err != nil {
+			log.Fatalf("Can't load the vocabularies: %s\n", err)
+		}
+	}
+
+	if appendCorpora {
+		if err := LoadManifest(); os.IsNotExist(err) {
+			log.Printf("No %s to append to, starting from scratch\n", MANIFEST_FILE)
+		} else if err != nil {
+			log.Fatalf("Can't load the previous vocabulary: %s\n", err)
+		}
+	}
+
+	/*
+		Parse demos on a pool of workers, then commit them in order as they come in.
+		Only so many demos are handed out ahead of the next one to commit, so that one slow demo doesn't leave every demo after it
+		(and all of their examples) piling up in memory.
+	*/
+	indices := make(chan int)
+	parsed := make(chan *ParsedDemo)
+	in_flight := make(chan struct{}, 2**jobs) // a slot for each demo handed out but not committed yet
+
+	var workers sync.WaitGroup
+
+	for i := 0; i < *jobs; i++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for index := range indices {
+				parsed <- ParseDemo(index, demo_names[index], selector, *singlePass)
+			}
+		}()
 	}
 
-	for i, demo_name := range os.Args[1:] {
-		log.Printf("Demo %d (%s)\n", i+1, demo_name)
+	go func() {
+		for index := range demo_names {
+			in_flight <- struct{}{}
+			indices <- index
+		}
+
+		close(indices)
+		workers.Wait()
+		close(parsed)
+	}()
+
+	waiting := make(map[int]*ParsedDemo) // demos that finished before the ones ahead of them
+	failures := []*ParsedDemo{}
+	next := 0
+
+	for demo := range parsed {
+		waiting[demo.Index] = demo
 
-		filehandle := OpenDemo(demo_name)
-		defer filehandle.Close()
+		for ; waiting[next] != nil; next++ {
+			demo := waiting[next]
+			delete(waiting, next)
 
-		top3, startTime := FirstPass(filehandle) // retrieve top 3 players
+			if demo.Err == nil {
+				demo.Err = CommitDemo(demo)
+			}
+
+			if demo.Err != nil {
+				log.Printf("Skipping demo %d (%s): %s\n", demo.Index+1, demo.Name, demo.Err)
+				failures = append(failures, demo)
+			}
 
-		for id, player := range top3 {
-			log.Println(id, player.Name, player.Kills)
+			<-in_flight
 		}
+	}
 
-		filehandle.Seek(0, 0) // go back to beginning of demo
+	if len(failures) > 0 {
+		log.Printf("%d of %d demos failed, see failed_demos.txt\n", len(failures), flag.NArg())
+
+		if err := WriteFailureReport(failures); err != nil {
+			log.Println(err)
+		}
+	}
 
-		SecondPass(filehandle, top3, float32(startTime)) // make examples
+	if err := CloseCorpora(); err != nil {
+		log.Fatalf("Error finalizing corpora: %s\n", err)
 	}
 }
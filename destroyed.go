@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/dotabuff/manta"
+)
+
+/*
+	Entities deleted during the current tick.
+	Manta applies entity deletions before the unit order callbacks run, so anything that got eaten, cut, picked up or killed by the
+	order is already gone from parser.PacketEntities by the time the order shows up. This keeps enough of them around to label them.
+*/
+type DestroyedEntities struct {
+	Tick     uint32
+	Entities map[int32]*TargetInfo // entindex -> what it was
+}
+
+func NewDestroyedEntities() *DestroyedEntities {
+	return &DestroyedEntities{0, make(map[int32]*TargetInfo)}
+}
+
+/* Records a deleted entity. Only entities with a position are kept, since those are the only ones that can be targeted. */
+func (destroyed *DestroyedEntities) Add(parser *manta.Parser, ent *manta.PacketEntity) {
+	if _, ok := ent.FetchUint64("CBodyComponentBaseAnimatingOverlay.m_cellX"); !ok {
+		return
+	}
+
+	if destroyed.Tick != parser.Tick { // anything older is stale
+		destroyed.Tick = parser.Tick
+		destroyed.Entities = make(map[int32]*TargetInfo)
+	}
+
+	destroyed.Entities[ent.Index] = NewTargetInfo(parser, ent)
+}
+
+/* Looks up an entity deleted this tick. */
+func (destroyed *DestroyedEntities) Lookup(parser *manta.Parser, index int32) (*TargetInfo, bool) {
+	if destroyed.Tick != parser.Tick {
+		return nil, false
+	}
+
+	info, ok := destroyed.Entities[index]
+
+	return info, ok
+}
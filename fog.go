@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/dotabuff/manta"
+)
+
+/* How long (in ticks) it takes for a sighting to count as completely stale (1 minute). */
+const LAST_SEEN_SCALE = 1800.0
+
+/* Where a hero was last seen by a team. */
+type Sighting struct {
+	X       float32 // mapped to [0, 1]
+	Y       float32
+	Tick    uint32
+	Visible bool
+}
+
+/* The last sightings of every hero (by entindex), for each team doing the seeing. */
+type Sightings map[uint64]map[int32]*Sighting
+
+func NewSightings() Sightings {
+	return Sightings{2: {}, 3: {}}
+}
+
+/* Checks if an entity is visible to a team (m_iTaggedAsVisibleByTeam has a bit for each team). */
+func IsVisibleTo(ent *manta.PacketEntity, team uint64) bool {
+	visibility, ok := ent.FetchInt32("m_iTaggedAsVisibleByTeam")
+
+	return ok && visibility&(1<<team) != 0
+}
+
+/* Records where each team saw a hero. Needs to be called on every update of the hero. */
+func (sightings Sightings) Update(parser *manta.Parser, ent *manta.PacketEntity) {
+	for team, seen := range sightings {
+		sighting, ok := seen[ent.Index]
+
+		if IsVisibleTo(ent, team) {
+			loc := ActiveProfile(parser).GetLocation(ent)
+			seen[ent.Index] = &Sighting{loc[0], loc[1], parser.Tick, true}
+		} else if ok && sighting.Visible { // just went into the fog, keep the last position it was seen at
+			sighting.Tick = parser.Tick
+			sighting.Visible = false
+		}
+	}
+}
+
+/*
+	Returns where a team thinks a hero is and how long ago it was last seen (0 if it's visible right now, 1 if it's been a minute or more).
+	Heroes the team has never seen are masked out as (0, 0) and 1.
+*/
+func (sightings Sightings) Lookup(parser *manta.Parser, ent *manta.PacketEntity, team uint64) (float32, float32, float32) {
+	if IsVisibleTo(ent, team) {
+		loc := ActiveProfile(parser).GetLocation(ent)
+		return loc[0], loc[1], 0.0
+	}
+
+	if sighting, ok := sightings[team][ent.Index]; ok {
+		since := float32(parser.Tick-sighting.Tick) / LAST_SEEN_SCALE
+
+		if since > 1.0 {
+			since = 1.0
+		}
+
+		return sighting.X, sighting.Y, since
+	}
+
+	return 0.0, 0.0, 1.0
+}
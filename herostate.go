@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/dotabuff/manta"
+)
+
+/* Optional groups of hero state in the move corpus, each switched on with its own feature. */
+type HeroState struct {
+	/* features.Economy */
+	ReliableGold   float32
+	UnreliableGold float32
+	NetWorth       float32
+
+	/* features.Farm */
+	LastHits float32
+	Denies   float32
+
+	/* features.Attributes */
+	Strength     float32
+	Agility      float32
+	Intelligence float32
+
+	/* features.Combat */
+	Damage      float32 // average of min and max, plus bonus damage
+	Armor       float32
+	MoveSpeed   float32
+	AttackRange float32
+
+	/* features.Alive */
+	Alive float32
+}
+
+/*
+	Reads the hero state of a player and the unit they gave an order to.
+	Gold and farm belong to the player (they live in the team data, see GetPlayerData), the rest is read off the unit itself.
+*/
+func GetHeroState(parser *manta.Parser, ent *manta.PacketEntity, teamData map[uint64]int32, team uint64, id int32) HeroState {
+	profile := ActiveProfile(parser)
+	state := HeroState{}
+
+	reliable, unreliable := GetGold(parser, teamData, team, id)
+
+	state.ReliableGold = float32(reliable) / profile.GoldScale
+	state.UnreliableGold = float32(unreliable) / profile.GoldScale
+	state.NetWorth = float32(GetPlayerData(parser, teamData, team, id, "m_iNetWorth")) / profile.NetWorthScale
+
+	state.LastHits = float32(GetPlayerData(parser, teamData, team, id, "m_iLastHitCount")) / profile.LastHitScale
+	state.Denies = float32(GetPlayerData(parser, teamData, team, id, "m_iDenyCount")) / profile.LastHitScale
+
+	strength, _ := ent.FetchFloat32("m_flStrengthTotal") // 0 for anything that isn't a hero
+	agility, _ := ent.FetchFloat32("m_flAgilityTotal")
+	intelligence, _ := ent.FetchFloat32("m_flIntellectTotal")
+
+	state.Strength = strength / profile.AttributeScale
+	state.Agility = agility / profile.AttributeScale
+	state.Intelligence = intelligence / profile.AttributeScale
+
+	damage_min, _ := ent.FetchInt32("m_iDamageMin")
+	damage_max, _ := ent.FetchInt32("m_iDamageMax")
+	damage_bonus, _ := ent.FetchInt32("m_iDamageBonus")
+	armor, _ := ent.FetchFloat32("m_flPhysicalArmorValue")
+	move_speed, _ := ent.FetchInt32("m_iMoveSpeed")
+	attack_range, _ := ent.FetchInt32("m_iAttackRange")
+
+	state.Damage = (float32(damage_min+damage_max)/2 + float32(damage_bonus)) / profile.DamageScale
+	state.Armor = armor / profile.ArmorScale
+	state.MoveSpeed = float32(move_speed) / profile.MoveSpeedScale
+	state.AttackRange = float32(attack_range) / profile.AttackRangeScale
+
+	if health, ok := ent.FetchInt32("m_iHealth"); ok && health > 0 {
+		state.Alive = 1.0
+	}
+
+	return state
+}
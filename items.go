@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dotabuff/manta"
+)
+
+/* Slots that hold items the hero can actually use: the 6 inventory slots, then the TP scroll and neutral item slots. */
+const USABLE_SLOTS = 8
+
+/* An item in one of the usable slots. */
+type ItemSlot struct {
+	Name     string  // "" if the slot is empty
+	Usable   float32 // 1 if it can be used right now (not on cooldown, enough charges)
+	Charges  int32
+	Cooldown float32 // cooldown / the profile's cooldown scale
+}
+
+/* Index in m_hItems of each usable slot, -1 if the patch doesn't have it. */
+func (profile *Profile) UsableSlotIndex(slot int) int {
+	if slot < BACKPACK_START {
+		return INVENTORY_START + slot
+	} else if slot == BACKPACK_START {
+		return profile.TPSlot
+	}
+
+	return profile.NeutralSlot
+}
+
+/* Retrieves what's in each of a hero's usable slots. */
+func GetItemSlots(parser *manta.Parser, entity *manta.PacketEntity) [USABLE_SLOTS]ItemSlot {
+	profile := ActiveProfile(parser)
+	slots := [USABLE_SLOTS]ItemSlot{}
+
+	for slot := range slots {
+		index := profile.UsableSlotIndex(slot)
+
+		if index == -1 {
+			continue
+		}
+
+		item_handle, ok := entity.FetchUint32(fmt.Sprintf("m_hItems.%04d", index))
+
+		if !ok {
+			continue
+		}
+
+		if item, ok := parser.PacketEntities[int32(item_handle&HANDLE_MAGIC)]; ok {
+			name := GetHammerName(parser, item)
+
+			if name == "" {
+				continue
+			}
+
+			charges, _ := item.FetchInt32("m_iCurrentCharges")
+			cooldown, _ := item.FetchFloat32("m_fCooldown")
+			requires_charges, _ := item.FetchBool("m_bRequiresCharges")
+
+			slots[slot].Name = name
+			slots[slot].Charges = charges
+			slots[slot].Cooldown = cooldown / profile.CooldownScale
+
+			if cooldown == 0 && (!requires_charges || charges > 0) {
+				slots[slot].Usable = 1.0
+			}
+		}
+	}
+
+	return slots
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/dotabuff/manta"
+	"math"
+)
+
+/* Lanes (same numbering as the bot API's LANE_* constants). */
+const (
+	LaneTop = iota + 1
+	LaneMid
+	LaneBot
+)
+
+/*
+	Projects a point onto a lane path.
+	Returns the distance between the point and the lane, and how far along the lane the point is (0 at the Radiant end, 1 at the Dire end).
+*/
+func ProjectOntoLane(path [][2]float32, x float32, y float32) (float32, float32) {
+	length := float32(0.0)
+
+	for i := 1; i < len(path); i++ {
+		length += float32(math.Hypot(float64(path[i][0]-path[i-1][0]), float64(path[i][1]-path[i-1][1])))
+	}
+
+	best := float32(math.MaxFloat32)
+	bestAmount := float32(0.0)
+	travelled := float32(0.0)
+
+	for i := 1; i < len(path); i++ {
+		startX, startY := path[i-1][0], path[i-1][1]
+		segX, segY := path[i][0]-startX, path[i][1]-startY
+		segLength := float32(math.Hypot(float64(segX), float64(segY)))
+
+		// closest point on the segment
+		t := ((x-startX)*segX + (y-startY)*segY) / (segLength * segLength)
+
+		if t < 0 {
+			t = 0
+		} else if t > 1 {
+			t = 1
+		}
+
+		dist := float32(math.Hypot(float64(startX+t*segX-x), float64(startY+t*segY-y)))
+
+		if dist < best {
+			best = dist
+			bestAmount = (travelled + t*segLength) / length
+		}
+
+		travelled += segLength
+	}
+
+	return best, bestAmount
+}
+
+/* Returns the lane closest to a point (in world coordinates), going by the lane paths of the profile. */
+func (profile *Profile) NearestLane(x float32, y float32) int {
+	best := float32(math.MaxFloat32)
+	bestLane := LaneMid
+
+	for lane := LaneTop; lane <= LaneBot; lane++ {
+		if dist, _ := ProjectOntoLane(profile.Lanes[lane], x, y); dist < best {
+			best = dist
+			bestLane = lane
+		}
+	}
+
+	return bestLane
+}
+
+/*
+	Computes how far a team's creeps have pushed down a lane, like GetLaneFrontAmount(team, lane, true) in the bot API.
+	0 means the front is at the team's own barracks, 1 means it's at the enemy's barracks.
+	laneCreeps maps the entindex of every lane creep being tracked to its team.
+*/
+func GetLaneFrontAmount(parser *manta.Parser, laneCreeps map[int32]uint64, team uint64, lane int) float32 {
+	profile := ActiveProfile(parser)
+	front := float32(0.0)
+
+	for index, creep_team := range laneCreeps {
+		if creep_team != team {
+			continue
+		}
+
+		creep, ok := parser.PacketEntities[index]
+
+		if !ok {
+			continue
+		}
+
+		if health, ok := creep.FetchInt32("m_iHealth"); !ok || health <= 0 { // dead creeps don't hold the lane
+			continue
+		}
+
+		loc := profile.GetWorldLocation(creep)
+
+		if profile.NearestLane(loc[0], loc[1]) != lane {
+			continue
+		}
+
+		_, amount := ProjectOntoLane(profile.Lanes[lane], loc[0], loc[1])
+
+		if team == 3 { // Dire pushes from the other end
+			amount = 1 - amount
+		}
+
+		if amount > front {
+			front = amount
+		}
+	}
+
+	return front
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+/*
+	Machine-readable counterpart to ability_data.lua, for tooling that isn't written in Lua.
+	It's also what append mode picks up from, so later runs can add to the corpora without shuffling IDs around (and what -vocab
+	reads the IDs to hand out from).
+*/
+const MANIFEST_FILE = "ability_data.json"
+
+/* The vocabularies of one corpus (a hero on a team). Names map to their IDs, labels in the corpora are ID + 1. */
+type Vocabulary struct {
+	Items           map[string]int `json:"items"`
+	Abilities       []string       `json:"abilities"` // in the same order as the cooldown columns
+	ActiveAbilities map[string]int `json:"activeAbilities"`
+	ActiveItems     map[string]int `json:"activeItems"`
+	Skills          map[string]int `json:"skills"`
+	EnemyHeroes     map[string]int `json:"enemyHeroes"`
+	Heroes          map[string]int `json:"heroes"`
+}
+
+/* Describes a group of columns in a corpus, in the order they're written. */
+type Column struct {
+	Name        string `json:"name"`
+	Count       int    `json:"count"`                // number of columns, 0 if it varies from row to row
+	Vocabulary  string `json:"vocabulary,omitempty"` // the values are IDs (or labels) from this vocabulary
+	Description string `json:"description"`
+}
+
+/* Everything written to MANIFEST_FILE. */
+type Manifest struct {
+	Heroes       map[string]map[uint64]*Vocabulary `json:"heroes"`    // hero -> team -> vocabularies
+	Teams        []map[string]uint64               `json:"teams"`     // hero -> team, for every match
+	Targets      []string                          `json:"targets"`   // names of the target labels, starting at 1
+	Orders       []string                          `json:"orders"`    // names of the order type labels, starting at 1
+	Modifiers    []string                          `json:"modifiers"` // the modifier vocabulary, in the order the columns are written (the channelling column comes after them)
+	MoveColumns  []Column                          `json:"moveColumns"`
+	BuildColumns []Column                          `json:"buildColumns"`
+	SkillColumns []Column                          `json:"skillColumns"`
+}
+
+/* Whether corpus files get appended to instead of truncated. */
+var appendCorpora bool
+
+/* Vocabularies given with -vocab (hero -> team -> vocabularies), loaded into each corpus as it's opened. */
+var fixedVocabularies map[string]map[uint64]*Vocabulary = make(map[string]map[uint64]*Vocabulary)
+
+/* Opens a corpus file for writing, either truncating it or appending to it. */
+func OpenCorpusFile(path string) (*os.File, error) {
+	if appendCorpora {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	}
+
+	return os.Create(path)
+}
+
+/* Writes the vocabularies of every corpus, the team compositions and the corpus layouts to MANIFEST_FILE. */
+func SaveManifest() error {
+	manifest := &Manifest{make(map[string]map[uint64]*Vocabulary), teams, targetNames, orderNames, modifierNames, MoveColumns(), buildColumns, skillColumns}
+
+	for hero, corpus := range corpora {
+		manifest.Heroes[hero] = make(map[uint64]*Vocabulary)
+
+		for i, team := range corpus {
+			manifest.Heroes[hero][uint64(i+2)] = &Vocabulary{
+				team.ObservedItems,
+				team.ObservedAbilities,
+				team.ObservedActiveAbilities,
+				team.ObservedActiveItems,
+				team.ObservedSkills,
+				team.ObservedEnemyHeroes,
+				team.ObservedHeroes,
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "\t") // map keys come out sorted, so this is deterministic
+
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(MANIFEST_FILE, data, 0644); err != nil {
+		return fmt.Errorf("error writing %s: %s", MANIFEST_FILE, err)
+	}
+
+	return nil
+}
+
+/*
+	Loads the vocabularies and team compositions saved by a previous run, and opens the corpora of every hero in it
+	(so that heroes that don't show up in this run still make it into ability_data.lua).
+	New names get the next free IDs, so the IDs already in the corpora stay valid.
+*/
+func LoadManifest() error {
+	manifest, err := ReadManifest(MANIFEST_FILE)
+
+	if err != nil {
+		return err
+	}
+
+	if !SameColumns(manifest.MoveColumns, MoveColumns()) || !SameColumns(manifest.BuildColumns, buildColumns) || !SameColumns(manifest.SkillColumns, skillColumns) {
+		return fmt.Errorf("the corpora in %s have a different layout, use the same features as the previous run", MANIFEST_FILE)
+	}
+
+	teams = append(teams, manifest.Teams...)
+
+	for hero, vocabularies := range manifest.Heroes {
+		corpus, err := GetCorpus(hero)
+
+		if err != nil {
+			return err
+		}
+
+		for team, vocabulary := range vocabularies {
+			corpus[team-2].LoadVocabulary(vocabulary)
+		}
+	}
+
+	return nil
+}
+
+/*
+	Loads the vocabularies from a manifest saved by an earlier run, to hand out the same IDs no matter which demos come first
+	(without it, IDs are handed out in the order names first show up, which depends on the order of the demo paths).
+	Unlike LoadManifest the corpora start from scratch, and the layout doesn't have to match.
+*/
+func LoadVocabularies(path string) error {
+	manifest, err := ReadManifest(path)
+
+	if err != nil {
+		return err
+	}
+
+	fixedVocabularies = manifest.Heroes
+
+	return nil
+}
+
+/* Reads a manifest, checking that the teams are valid. */
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	for hero, vocabularies := range manifest.Heroes {
+		for team := range vocabularies {
+			if team != 2 && team != 3 {
+				return nil, fmt.Errorf("error reading %s: hero %s has unknown team %d", path, hero, team)
+			}
+		}
+	}
+
+	return manifest, nil
+}
+
+/* Copies saved vocabularies into the observed ones of a corpus. */
+func (corpus *Corpus) LoadVocabulary(vocabulary *Vocabulary) {
+	LoadObserved(corpus.ObservedItems, vocabulary.Items)
+	LoadObserved(corpus.ObservedActiveAbilities, vocabulary.ActiveAbilities)
+	LoadObserved(corpus.ObservedActiveItems, vocabulary.ActiveItems)
+	LoadObserved(corpus.ObservedSkills, vocabulary.Skills)
+	LoadObserved(corpus.ObservedEnemyHeroes, vocabulary.EnemyHeroes)
+	LoadObserved(corpus.ObservedHeroes, vocabulary.Heroes)
+
+	corpus.ObservedAbilities = append(corpus.ObservedAbilities, vocabulary.Abilities...)
+}
+
+/* Checks if two corpus layouts are the same (ignoring the descriptions). */
+func SameColumns(a []Column, b []Column) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Count != b[i].Count || a[i].Vocabulary != b[i].Vocabulary {
+			return false
+		}
+	}
+
+	return true
+}
+
+/* Copies a saved vocabulary into an observed one. */
+func LoadObserved(observed map[string]int, saved map[string]int) {
+	for name, id := range saved {
+		observed[name] = id
+	}
+}
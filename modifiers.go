@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dotabuff/manta"
+	"github.com/dotabuff/manta/dota"
+)
+
+/*
+	Modifiers worth knowing about when deciding what to do (disables, invisibility, spell immunity, teleports...), in the order they're
+	written. Add to the end so the old columns keep their meaning, and note that it changes the layout of the corpora.
+	Channelling mostly doesn't show up as a modifier, so it gets its own column after these (see IsChannelling).
+*/
+var modifierNames []string = []string{
+	"modifier_stunned",
+	"modifier_bashed",
+	"modifier_silence",
+	"modifier_doom_bringer_doom",
+	"modifier_sheepstick_debuff",
+	"modifier_lion_voodoo",
+	"modifier_shadow_shaman_voodoo",
+	"modifier_rooted",
+	"modifier_disarmed",
+	"modifier_eul_cyclone",
+	"modifier_invisible",
+	"modifier_item_invisibility_edge_windwalk",
+	"modifier_item_silver_edge_windwalk",
+	"modifier_smoke_of_deceit",
+	"modifier_black_king_bar_immune",
+	"modifier_item_lotus_orb_active",
+	"modifier_item_blade_mail_reflect",
+	"modifier_teleporting",
+	"modifier_fountain_aura_buff",
+}
+
+/* Columns written for each unit: one per modifier in modifierNames, then whether the unit is channelling. */
+var modifierColumns int = len(modifierNames) + 1
+
+/* Index of each modifier in modifierNames. */
+var modifierIndices map[string]int = func() map[string]int {
+	indices := make(map[string]int)
+
+	for i, name := range modifierNames {
+		indices[name] = i
+	}
+
+	return indices
+}()
+
+/* A modifier table entry is identified by its index and serial number. */
+type modifierKey struct {
+	Index     int32
+	SerialNum int32
+}
+
+/* The modifiers from modifierNames that are currently active, by the entindex of the unit they're on. */
+type Modifiers map[int32]map[modifierKey]string
+
+/* Registers the callback that keeps track of the active modifiers. */
+func WatchModifiers(parser *manta.Parser) Modifiers {
+	modifiers := make(Modifiers)
+
+	parser.OnModifierTableEntry(func(msg *dota.CDOTAModifierBuffTableEntry) error {
+		parent := int32(msg.GetParent() & HANDLE_MAGIC)
+		key := modifierKey{msg.GetIndex(), msg.GetSerialNum()}
+
+		if msg.GetEntryType() == dota.DOTA_MODIFIER_ENTRY_TYPE_DOTA_MODIFIER_ENTRY_TYPE_REMOVED {
+			delete(modifiers[parent], key)
+			return nil
+		}
+
+		name, ok := parser.LookupStringByIndex("ModifierNames", msg.GetModifierClass())
+
+		if _, important := modifierIndices[name]; !ok || !important {
+			return nil
+		}
+
+		if _, ok := modifiers[parent]; !ok {
+			modifiers[parent] = make(map[modifierKey]string)
+		}
+
+		modifiers[parent][key] = name
+
+		return nil
+	})
+
+	return modifiers
+}
+
+/*
+	Returns which of the modifiers in modifierNames are on a unit, 1 or 0 for each, then 1 or 0 for whether it's channelling
+	(modifierColumns values in all).
+*/
+func (modifiers Modifiers) Active(parser *manta.Parser, ent *manta.PacketEntity) []float32 {
+	active := make([]float32, modifierColumns)
+
+	for _, name := range modifiers[ent.Index] {
+		active[modifierIndices[name]] = 1.0
+	}
+
+	if IsChannelling(parser, ent) {
+		active[len(modifierNames)] = 1.0
+	}
+
+	return active
+}
+
+/*
+	Checks whether a unit is channelling one of its abilities or items (a TP scroll, Black Hole, Drain Life...).
+	The game sets m_flChannelStartTime on the ability while it's being channelled, and resets it to 0 once the channel ends.
+*/
+func IsChannelling(parser *manta.Parser, ent *manta.PacketEntity) bool {
+	for _, field := range []string{"m_hAbilities", "m_hItems"} {
+		for count := 0; ; count++ {
+			handle, ok := ent.FetchUint32(fmt.Sprintf("%s.%04d", field, count))
+
+			if !ok {
+				break
+			}
+
+			if ability, ok := parser.PacketEntities[int32(handle&HANDLE_MAGIC)]; ok {
+				if start, ok := ability.FetchFloat32("m_flChannelStartTime"); ok && start > 0 {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
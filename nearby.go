@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/dotabuff/manta"
+)
+
+/* A unit near the hero. */
+type NearbyUnit struct {
+	DX     float32 // position relative to the hero, in the same [0, 1] mapping as everything else
+	DY     float32
+	Health float32 // fraction of max health
+	Allied float32 // 1 if it's on the hero's team
+	Type   int     // one of the Target* constants
+}
+
+/* Whether a unit is something that can go in the nearest units: lane creeps, neutrals, towers and summons. */
+func IsNearbyCandidate(parser *manta.Parser, ent *manta.PacketEntity) bool {
+	switch targetClasses[ent.ClassName] {
+	case TargetLane, TargetJungle, TargetTower:
+		return true
+	}
+
+	if IsHero(ent) {
+		return false
+	}
+
+	_, unit_type := ResolveUnit(parser, nil, ent)
+
+	return unit_type == UnitSummon
+}
+
+/*
+	Returns the k units closest to a hero, closest first (fewer if there aren't that many alive).
+	With features.FogOfWar, only units the hero's team can see count.
+*/
+func GetNearestUnits(parser *manta.Parser, hero *manta.PacketEntity, team uint64, k int) []NearbyUnit {
+	profile := ActiveProfile(parser)
+	origin := profile.GetWorldLocation(hero)
+
+	type candidate struct {
+		ent      *manta.PacketEntity
+		distance float32
+	}
+
+	candidates := []candidate{}
+
+	for _, ent := range parser.PacketEntities {
+		if ent.Index == hero.Index || !IsNearbyCandidate(parser, ent) {
+			continue
+		}
+
+		if health, ok := ent.FetchInt32("m_iHealth"); !ok || health <= 0 {
+			continue
+		}
+
+		if features.FogOfWar && !IsVisibleTo(ent, team) {
+			continue
+		}
+
+		loc := profile.GetWorldLocation(ent)
+		dx, dy := loc[0]-origin[0], loc[1]-origin[1]
+
+		candidates = append(candidates, candidate{ent, dx*dx + dy*dy})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+
+		return candidates[i].ent.Index < candidates[j].ent.Index // map order is random, keep it deterministic
+	})
+
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+
+	hero_loc := profile.GetLocation(hero)
+	units := make([]NearbyUnit, 0, len(candidates))
+
+	for _, c := range candidates {
+		loc := profile.GetLocation(c.ent)
+		health, _ := c.ent.FetchInt32("m_iHealth")
+		max_health, _ := c.ent.FetchInt32("m_iMaxHealth")
+		unit_team, _ := c.ent.FetchUint64("m_iTeamNum")
+
+		unit := NearbyUnit{loc[0] - hero_loc[0], loc[1] - hero_loc[1], 0.0, 0.0, ClassifyTarget(parser, c.ent, team)}
+
+		if max_health > 0 {
+			unit.Health = float32(health) / float32(max_health)
+		}
+
+		if unit_team == team {
+			unit.Allied = 1.0
+		}
+
+		units = append(units, unit)
+	}
+
+	return units
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/dotabuff/manta"
+)
+
+/*
+	Map geometry and the scales features get normalized by, for a range of game builds.
+	These change from patch to patch (the map got bigger, the level cap went up...), so each demo uses the profile of the build it was
+	recorded on.
+*/
+type Profile struct {
+	Name     string `json:"name"`
+	MinBuild uint32 `json:"minBuild"` // first build (parser.GameBuild, the dota_v number of the server) the profile applies to, it lasts until the next profile's
+
+	MinX       float32 `json:"minX"` // map bounds, in world coordinates
+	MaxX       float32 `json:"maxX"`
+	MinY       float32 `json:"minY"`
+	MaxY       float32 `json:"maxY"`
+	CellSize   float32 `json:"cellSize"`
+	CellOrigin float32 `json:"cellOrigin"` // world coordinate of the corner of cell 0 (the same on both axes)
+
+	/*
+		Approximate paths the creep waves take down each lane (LaneTop, LaneMid, LaneBot), in world coordinates, going from the Radiant
+		barracks to the Dire barracks. They only need to be good enough to tell which lane a creep is in and how far along it has pushed.
+	*/
+	Lanes map[int][][2]float32 `json:"lanes"`
+
+	TPSlot      int `json:"tpSlot"`      // index in m_hItems of the TP scroll slot, -1 before it existed
+	NeutralSlot int `json:"neutralSlot"` // index in m_hItems of the neutral item slot, -1 before it existed
+
+	MaxLevel      float32 `json:"maxLevel"`
+	CooldownScale float32 `json:"cooldownScale"` // seconds
+	GoldScale     float32 `json:"goldScale"`
+	NetWorthScale float32 `json:"netWorthScale"`
+	TimeScale     float32 `json:"timeScale"` // seconds
+
+	LastHitScale     float32 `json:"lastHitScale"` // last hits and denies
+	AttributeScale   float32 `json:"attributeScale"`
+	DamageScale      float32 `json:"damageScale"`
+	ArmorScale       float32 `json:"armorScale"`
+	MoveSpeedScale   float32 `json:"moveSpeedScale"`
+	AttackRangeScale float32 `json:"attackRangeScale"`
+}
+
+/*
+	Known profiles, sorted by MinBuild: one for each patch that changed the map or the level cap. Profiles for other patches can be
+	added with -profiles (see LoadProfiles).
+*/
+var profiles []*Profile = []*Profile{
+	{
+		Name:     "7.02",
+		MinBuild: 0,
+
+		MinX:       -8288.0,
+		MaxX:       8288.0,
+		MinY:       -8288.0,
+		MaxY:       8288.0,
+		CellSize:   128.0,
+		CellOrigin: -16577.0,
+
+		Lanes: map[int][][2]float32{
+			LaneTop: {{-6600, -3700}, {-6200, 5800}, {3700, 5900}},
+			LaneMid: {{-4300, -3900}, {3900, 3500}},
+			LaneBot: {{-3900, -6200}, {6000, -6200}, {6300, 3400}},
+		},
+
+		TPSlot:      -1,
+		NeutralSlot: -1,
+
+		MaxLevel:      25.0,
+		CooldownScale: 360.0,
+		GoldScale:     10000.0,
+		NetWorthScale: 50000.0,
+		TimeScale:     3600.0, // 1 = 60 minutes
+
+		LastHitScale:     500.0,
+		AttributeScale:   100.0,
+		DamageScale:      500.0,
+		ArmorScale:       50.0,
+		MoveSpeedScale:   550.0, // the cap
+		AttackRangeScale: 1000.0,
+	},
+	{
+		Name:     "7.23", // level cap up to 30, TP scroll and neutral item slots
+		MinBuild: 3933,
+
+		MinX:       -8288.0,
+		MaxX:       8288.0,
+		MinY:       -8288.0,
+		MaxY:       8288.0,
+		CellSize:   128.0,
+		CellOrigin: -16577.0,
+
+		Lanes: map[int][][2]float32{
+			LaneTop: {{-6600, -3700}, {-6200, 5800}, {3700, 5900}},
+			LaneMid: {{-4300, -3900}, {3900, 3500}},
+			LaneBot: {{-3900, -6200}, {6000, -6200}, {6300, 3400}},
+		},
+
+		TPSlot:      15,
+		NeutralSlot: 16,
+
+		MaxLevel:      30.0,
+		CooldownScale: 360.0,
+		GoldScale:     10000.0,
+		NetWorthScale: 50000.0,
+		TimeScale:     3600.0,
+
+		LastHitScale:     500.0,
+		AttributeScale:   100.0,
+		DamageScale:      500.0,
+		ArmorScale:       50.0,
+		MoveSpeedScale:   550.0,
+		AttackRangeScale: 1000.0,
+	},
+	{
+		Name:     "7.33", // the map got about 40% bigger
+		MinBuild: 5588,
+
+		MinX:       -9800.0,
+		MaxX:       9800.0,
+		MinY:       -9800.0,
+		MaxY:       9800.0,
+		CellSize:   128.0,
+		CellOrigin: -16577.0,
+
+		Lanes: map[int][][2]float32{
+			LaneTop: {{-7200, -4100}, {-6900, 6500}, {4100, 6600}},
+			LaneMid: {{-4700, -4300}, {4300, 3900}},
+			LaneBot: {{-4300, -6900}, {6600, -6900}, {7000, 3800}},
+		},
+
+		TPSlot:      15,
+		NeutralSlot: 16,
+
+		MaxLevel:      30.0,
+		CooldownScale: 360.0,
+		GoldScale:     10000.0,
+		NetWorthScale: 50000.0,
+		TimeScale:     3600.0,
+
+		LastHitScale:     500.0,
+		AttributeScale:   100.0,
+		DamageScale:      500.0,
+		ArmorScale:       50.0,
+		MoveSpeedScale:   550.0,
+		AttackRangeScale: 1000.0,
+	},
+}
+
+/* Returns the profile for a game build: the last one starting at or before it. */
+func ProfileFor(build uint32) *Profile {
+	active := profiles[0]
+
+	for _, profile := range profiles {
+		if profile.MinBuild <= build {
+			active = profile
+		}
+	}
+
+	return active
+}
+
+/* Returns the profile for the demo being parsed. */
+func ActiveProfile(parser *manta.Parser) *Profile {
+	return ProfileFor(parser.GameBuild)
+}
+
+/*
+	Loads extra profiles from a JSON file (a list of profiles, in the same format as above).
+	A profile with the same MinBuild as a known one replaces it.
+*/
+func LoadProfiles(path string) error {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	loaded := []*Profile{}
+
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("error reading %s: %s", path, err)
+	}
+
+	for _, profile := range loaded {
+		if profile.MaxX <= profile.MinX || profile.MaxY <= profile.MinY || profile.CellSize <= 0 {
+			return fmt.Errorf("error reading %s: profile %q has bad map bounds", path, profile.Name)
+		}
+
+		for _, slot := range []int{profile.TPSlot, profile.NeutralSlot} {
+			if slot != -1 && slot < STASH_END {
+				return fmt.Errorf("error reading %s: profile %q has bad item slots (-1 if the patch doesn't have them)", path, profile.Name)
+			}
+		}
+
+		for lane := LaneTop; lane <= LaneBot; lane++ {
+			if len(profile.Lanes[lane]) < 2 {
+				return fmt.Errorf("error reading %s: profile %q needs a path of at least 2 points for lane %d", path, profile.Name, lane)
+			}
+		}
+
+		scales := []float32{
+			profile.MaxLevel, profile.CooldownScale, profile.GoldScale, profile.NetWorthScale, profile.TimeScale,
+			profile.LastHitScale, profile.AttributeScale, profile.DamageScale, profile.ArmorScale, profile.MoveSpeedScale, profile.AttackRangeScale,
+		}
+
+		for _, scale := range scales {
+			if scale <= 0 {
+				return fmt.Errorf("error reading %s: profile %q has bad scales (they all need to be set)", path, profile.Name)
+			}
+		}
+
+		replaced := false
+
+		for i, known := range profiles {
+			if known.MinBuild == profile.MinBuild {
+				profiles[i], replaced = profile, true
+			}
+		}
+
+		if !replaced {
+			profiles = append(profiles, profile)
+		}
+	}
+
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].MinBuild < profiles[j].MinBuild
+	})
+
+	return nil
+}
+
+/* Linearly maps coordinate components to [0, 1]. */
+func (profile *Profile) RemapX(x float32) float32 {
+	return (x - profile.MinX) / (profile.MaxX - profile.MinX)
+}
+
+func (profile *Profile) RemapY(y float32) float32 {
+	return (y - profile.MinY) / (profile.MaxY - profile.MinY)
+}
+
+/*
+	Retrieves the location of an entity.
+
+	Unlike the standard m_vecOrigin netprop in most Source games, Dota 2 splits an entity's location up into two parts in replays:
+
+	- m_cellX, m_cellY: This represents which "cell" a location is in, with the map split into 128x128 cells.
+	- m_offsetX, m_offsetY: This then represents the offset of an entity within the cell, relative to its lower left corner.
+
+	(The Dota 2 map was 16577 x 16577 with the origin at its center as of 7.02, and it's changed since. That's what the profiles are for.)
+	This function takes those components and turns it into a regular Cartesian coordinate, since that's what the bot API uses.
+*/
+func (profile *Profile) GetWorldLocation(ent *manta.PacketEntity) []float32 {
+	cellX, _ := ent.FetchUint64("CBodyComponentBaseAnimatingOverlay.m_cellX")
+	cellY, _ := ent.FetchUint64("CBodyComponentBaseAnimatingOverlay.m_cellY")
+
+	offsetX, _ := ent.FetchFloat32("CBodyComponentBaseAnimatingOverlay.m_vecX")
+	offsetY, _ := ent.FetchFloat32("CBodyComponentBaseAnimatingOverlay.m_vecY")
+
+	return []float32{
+		float32(cellX)*profile.CellSize + profile.CellOrigin + offsetX,
+		float32(cellY)*profile.CellSize + profile.CellOrigin + offsetY,
+	}
+}
+
+/* Retrieves the location of an entity, mapped to [0, 1]. */
+func (profile *Profile) GetLocation(ent *manta.PacketEntity) []float32 {
+	loc := profile.GetWorldLocation(ent)
+
+	return []float32{profile.RemapX(loc[0]), profile.RemapY(loc[1])}
+}
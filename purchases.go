@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/dotabuff/manta"
+)
+
+/*
+	How many ticks after a purchase order the item it bought can show up (1 second).
+	Manta runs entity callbacks before the user message callbacks of the same tick, so the item can also show up in the order's own tick,
+	right before it. Items from earlier ticks never go with a later order (they're combines after a courier delivery and the like).
+*/
+const PURCHASE_WINDOW = 30
+
+/* An item that showed up for a player's hero, with the build example made out of the state right before it did. */
+type BoughtItem struct {
+	Tick    uint32
+	Hero    string
+	Team    uint64
+	Example *BuildExample
+}
+
+/*
+	Matches purchase orders up with the items they bought.
+	Orders only have the item's definition ID, not its name, and items get created for plenty of things that aren't purchases
+	(illusions copying the inventory, Tempest Double...), so a build example only gets made when both an order and an item show up.
+*/
+type Purchases struct {
+	Orders map[int32][]uint32      // player ID -> ticks of the orders that haven't bought anything yet
+	Items  map[int32][]*BoughtItem // player ID -> items that haven't been matched to an order yet
+}
+
+func NewPurchases() *Purchases {
+	return &Purchases{make(map[int32][]uint32), make(map[int32][]*BoughtItem)}
+}
+
+/* Drops orders that are too old to be matched, and items from before the current tick. */
+func (purchases *Purchases) expire(parser *manta.Parser, id int32) {
+	orders := purchases.Orders[id][:0]
+
+	for _, tick := range purchases.Orders[id] {
+		if parser.Tick-tick <= PURCHASE_WINDOW {
+			orders = append(orders, tick)
+		}
+	}
+
+	items := purchases.Items[id][:0]
+
+	for _, item := range purchases.Items[id] {
+		if item.Tick == parser.Tick {
+			items = append(items, item)
+		}
+	}
+
+	purchases.Orders[id], purchases.Items[id] = orders, items
+}
+
+/* Records a purchase order. Returns the item it bought if it already showed up this tick, nil otherwise. */
+func (purchases *Purchases) Order(parser *manta.Parser, id int32) *BoughtItem {
+	purchases.expire(parser, id)
+
+	if items := purchases.Items[id]; len(items) > 0 {
+		purchases.Items[id] = items[1:]
+		return items[0]
+	}
+
+	purchases.Orders[id] = append(purchases.Orders[id], parser.Tick)
+
+	return nil
+}
+
+/* Records an item bought for a player's hero. Returns it if there's an order it goes with, nil if it has to wait for one. */
+func (purchases *Purchases) Item(parser *manta.Parser, id int32, item *BoughtItem) *BoughtItem {
+	purchases.expire(parser, id)
+
+	if orders := purchases.Orders[id]; len(orders) > 0 {
+		purchases.Orders[id] = orders[1:]
+		return item
+	}
+
+	purchases.Items[id] = append(purchases.Items[id], item)
+
+	return nil
+}
+
+/*
+	Gold of each player as of the last tick, so build examples get the gold the player had when they decided to buy something.
+	By the time the item shows up, the team data has usually been updated in the same tick with the price taken off.
+*/
+type GoldHistory struct {
+	Tick     uint32
+	Previous map[int32][2]int32 // player ID -> reliable and unreliable gold, before any update during Tick
+	Current  map[int32][2]int32 // player ID -> reliable and unreliable gold, as of the latest update
+}
+
+func NewGoldHistory() *GoldHistory {
+	return &GoldHistory{0, make(map[int32][2]int32), make(map[int32][2]int32)}
+}
+
+/* Records the gold of the players of a team from their team data (CDOTA_DataRadiant/CDOTA_DataDire). */
+func (history *GoldHistory) Update(parser *manta.Parser, data *manta.PacketEntity, team uint64) {
+	if history.Tick != parser.Tick {
+		history.Tick = parser.Tick
+		history.Previous = make(map[int32][2]int32)
+
+		for id, gold := range history.Current {
+			history.Previous[id] = gold
+		}
+	}
+
+	for slot := int32(0); slot < 5; slot++ {
+		reliable, ok := data.FetchInt32(fmt.Sprintf("m_vecDataTeam.%04d.m_iReliableGold", slot))
+
+		if !ok {
+			continue
+		}
+
+		unreliable, _ := data.FetchInt32(fmt.Sprintf("m_vecDataTeam.%04d.m_iUnreliableGold", slot))
+
+		id := slot
+
+		if team == 3 {
+			id += 5
+		}
+
+		history.Current[id] = [2]int32{reliable, unreliable}
+	}
+}
+
+/* Returns the reliable and unreliable gold a player had before the current tick. */
+func (history *GoldHistory) Lookup(parser *manta.Parser, id int32) (int32, int32) {
+	gold := history.Current[id]
+
+	if history.Tick == parser.Tick {
+		gold = history.Previous[id]
+	}
+
+	return gold[0], gold[1]
+}
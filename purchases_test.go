@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dotabuff/manta"
+)
+
+/* A purchase order or an item showing up for player 0, and whether it should complete a match. */
+type purchaseEvent struct {
+	Tick    uint32
+	Item    string // "" for an order
+	Matched string // the item the event should be matched with, "" for none
+}
+
+func TestPurchases(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Events []purchaseEvent
+	}{
+		{"item before the order in the same tick", []purchaseEvent{
+			{100, "item_tango", ""},
+			{100, "", "item_tango"},
+		}},
+		{"item a few ticks after the order", []purchaseEvent{
+			{100, "", ""},
+			{110, "item_tango", "item_tango"},
+		}},
+		{"item too long after the order", []purchaseEvent{
+			{100, "", ""},
+			{100 + PURCHASE_WINDOW + 1, "item_tango", ""},
+		}},
+		{"stale item doesn't go with a later order", []purchaseEvent{
+			{100, "item_magic_wand", ""},
+			{105, "", ""},
+			{110, "item_tango", "item_tango"},
+		}},
+		{"one item per order", []purchaseEvent{
+			{100, "", ""},
+			{101, "item_tango", "item_tango"},
+			{102, "item_clarity", ""},
+		}},
+		{"orders are matched in order", []purchaseEvent{
+			{100, "", ""},
+			{101, "", ""},
+			{102, "item_tango", "item_tango"},
+			{103, "item_clarity", "item_clarity"},
+			{104, "item_flask", ""},
+		}},
+		{"several items before their orders in the same tick", []purchaseEvent{
+			{100, "item_tango", ""},
+			{100, "item_clarity", ""},
+			{100, "", "item_tango"},
+			{100, "", "item_clarity"},
+			{100, "", ""},
+		}},
+	}
+
+	for _, test := range tests {
+		purchases := NewPurchases()
+		parser := &manta.Parser{}
+
+		for i, event := range test.Events {
+			parser.Tick = event.Tick
+
+			var bought *BoughtItem
+
+			if event.Item == "" {
+				bought = purchases.Order(parser, 0)
+			} else {
+				bought = purchases.Item(parser, 0, &BoughtItem{event.Tick, "npc_dota_hero_axe", 2, &BuildExample{ItemBought: event.Item}})
+			}
+
+			matched := ""
+
+			if bought != nil {
+				matched = bought.Example.ItemBought
+			}
+
+			if matched != event.Matched {
+				t.Errorf("%s: event %d matched %q, expected %q", test.Name, i, matched, event.Matched)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* Represents a player and their end of game stats, gathered in the first pass. */
+type Player struct {
+	ID      int32
+	Name    string
+	SteamID uint64
+	Team    uint64
+
+	Kills      int32
+	Deaths     int32
+	Assists    int32
+	LastHits   int32
+	HeroDamage int32
+	GPM        float32
+	XPM        float32
+}
+
+/* (Kills + assists) / deaths, with deathless games counting as one death. */
+func (player *Player) KDA() float32 {
+	deaths := player.Deaths
+
+	if deaths < 1 {
+		deaths = 1
+	}
+
+	return float32(player.Kills+player.Assists) / float32(deaths)
+}
+
+/* Stats players can be ranked by. */
+var playerStats map[string]func(*Player) float32 = map[string]func(*Player) float32{
+	"kills":      func(player *Player) float32 { return float32(player.Kills) },
+	"kda":        func(player *Player) float32 { return player.KDA() },
+	"gpm":        func(player *Player) float32 { return player.GPM },
+	"xpm":        func(player *Player) float32 { return player.XPM },
+	"lasthits":   func(player *Player) float32 { return float32(player.LastHits) },
+	"herodamage": func(player *Player) float32 { return float32(player.HeroDamage) },
+}
+
+/* Decides which players in a match get their actions turned into examples. winningTeam is 0 if the winner isn't known. */
+type PlayerSelector interface {
+	Select(players []*Player, winningTeam uint64) map[int32]*Player
+}
+
+/* Selects everyone. */
+type AllPlayers struct{}
+
+func (selector *AllPlayers) Select(players []*Player, _ uint64) map[int32]*Player {
+	selected := make(map[int32]*Player)
+
+	for _, player := range players {
+		selected[player.ID] = player
+	}
+
+	return selected
+}
+
+/* Selects everyone on the winning team. */
+type WinningTeam struct{}
+
+func (selector *WinningTeam) Select(players []*Player, winningTeam uint64) map[int32]*Player {
+	selected := make(map[int32]*Player)
+
+	for _, player := range players {
+		if player.Team == winningTeam {
+			selected[player.ID] = player
+		}
+	}
+
+	return selected
+}
+
+/* Selects the N players with the highest value of a stat, optionally only looking at the winning team. */
+type TopPlayers struct {
+	N           int
+	Stat        string
+	WinnersOnly bool
+}
+
+func (selector *TopPlayers) Select(players []*Player, winningTeam uint64) map[int32]*Player {
+	candidates := []*Player{}
+
+	for _, player := range players {
+		if !selector.WinnersOnly || player.Team == winningTeam {
+			candidates = append(candidates, player)
+		}
+	}
+
+	stat := playerStats[selector.Stat]
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return stat(candidates[i]) > stat(candidates[j])
+	})
+
+	selected := make(map[int32]*Player)
+
+	for i := 0; i < selector.N && i < len(candidates); i++ {
+		selected[candidates[i].ID] = candidates[i]
+	}
+
+	return selected
+}
+
+/* Selects players by Steam ID (for imitating specific players). */
+type SteamIDs struct {
+	IDs map[uint64]bool
+}
+
+func (selector *SteamIDs) Select(players []*Player, _ uint64) map[int32]*Player {
+	selected := make(map[int32]*Player)
+
+	for _, player := range players {
+		if selector.IDs[player.SteamID] {
+			selected[player.ID] = player
+		}
+	}
+
+	return selected
+}
+
+/*
+	Creates a player selector from the command line options.
+
+	- policy: one of "all", "winners", "top" or "steamids"
+	- n, stat, winnersOnly: how many players to take, what to rank them by and whether to only look at the winning team ("top" only)
+	- steamIDs: comma separated list of 64 bit Steam IDs ("steamids" only)
+*/
+func NewPlayerSelector(policy string, n int, stat string, winnersOnly bool, steamIDs string) (PlayerSelector, error) {
+	switch policy {
+	case "all":
+		return &AllPlayers{}, nil
+
+	case "winners":
+		return &WinningTeam{}, nil
+
+	case "top":
+		if _, ok := playerStats[stat]; !ok {
+			return nil, fmt.Errorf("unknown stat %q", stat)
+		}
+
+		if n < 1 {
+			return nil, fmt.Errorf("need to select at least one player, got %d", n)
+		}
+
+		return &TopPlayers{n, stat, winnersOnly}, nil
+
+	case "steamids":
+		ids := make(map[uint64]bool)
+
+		for _, field := range strings.Split(steamIDs, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				continue
+			}
+
+			id, err := strconv.ParseUint(field, 10, 64)
+
+			if err != nil {
+				return nil, fmt.Errorf("bad Steam ID %q", field)
+			}
+
+			ids[id] = true
+		}
+
+		if len(ids) == 0 {
+			return nil, fmt.Errorf("no Steam IDs given")
+		}
+
+		return &SteamIDs{ids}, nil
+	}
+
+	return nil, fmt.Errorf("unknown player selection policy %q", policy)
+}
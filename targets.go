@@ -0,0 +1,127 @@
+package main
+
+import (
+	"github.com/dotabuff/manta"
+)
+
+/* What an attack or ability was aimed at. New kinds of targets go at the end so the old labels keep their meaning. */
+const (
+	TargetTower = iota + 1
+	TargetBuilding
+	TargetSelf
+	TargetTree
+	TargetJungle
+	TargetLane
+	TargetEnemyHero
+	TargetFriendlyHero
+	TargetWard
+	TargetCourier
+	TargetRune
+	TargetRoshan
+	TargetSummon
+	TargetIllusion
+	TargetItem // lying on the ground
+	TargetBarracks
+	TargetShrine // shrines and outposts
+	TargetAncient
+)
+
+/* Names of the Target* constants, in order (written out so the trainer knows how many labels there are). */
+var targetNames []string = []string{
+	"tower",
+	"building",
+	"self",
+	"tree",
+	"jungle",
+	"lane",
+	"enemyHero",
+	"friendlyHero",
+	"ward",
+	"courier",
+	"rune",
+	"roshan",
+	"summon",
+	"illusion",
+	"item",
+	"barracks",
+	"shrine",
+	"ancient",
+}
+
+/*
+	Targets that can be told apart by their class alone. Add classes here to give them their own label.
+	Anything that isn't a hero, isn't in here and isn't someone's summon counts as TargetBuilding.
+*/
+var targetClasses map[string]int = map[string]int{
+	TOWER:                               TargetTower,
+	LANE_CREEP:                          TargetLane,
+	"CDOTA_BaseNPC_Creep_Siege":         TargetLane,
+	JUNGLE_CREEP:                        TargetJungle,
+	"CDOTA_NPC_Observer_Ward":           TargetWard,
+	"CDOTA_NPC_Observer_Ward_TrueSight": TargetWard,
+	"CDOTA_Unit_Courier":                TargetCourier,
+	RUNE:                                TargetRune,
+	"CDOTA_Unit_Roshan":                 TargetRoshan,
+	"CDOTA_Item_Physical":               TargetItem,
+	"CDOTA_BaseNPC_Barracks":            TargetBarracks,
+	"CDOTA_BaseNPC_Healer":              TargetShrine,
+	"CDOTA_BaseNPC_Watch_Tower":         TargetShrine,
+	ANCIENT:                             TargetAncient,
+	"CDOTA_TempTree":                    TargetTree,
+}
+
+/* What's needed to label a target, so it can still be labelled after the entity is gone (see DestroyedEntities). */
+type TargetInfo struct {
+	ClassName string
+	Team      uint64
+	Hero      bool
+	Illusion  bool
+	Summon    bool
+	X         float32 // mapped to [0, 1]
+	Y         float32
+}
+
+func NewTargetInfo(parser *manta.Parser, ent *manta.PacketEntity) *TargetInfo {
+	team, _ := ent.FetchUint64("m_iTeamNum")
+	loc := ActiveProfile(parser).GetLocation(ent)
+
+	info := &TargetInfo{ent.ClassName, team, IsHero(ent), false, false, loc[0], loc[1]}
+
+	if info.Hero {
+		info.Illusion = IsIllusion(ent)
+	} else if _, unit_type := ResolveUnit(parser, nil, ent); unit_type == UnitSummon {
+		info.Summon = true
+	}
+
+	return info
+}
+
+/* Works out the target label for a target of a unit on the given team. */
+func (info *TargetInfo) Classify(team uint64) int {
+	if info.Hero {
+		if info.Illusion {
+			return TargetIllusion
+		}
+
+		if info.Team == team {
+			return TargetFriendlyHero
+		}
+
+		return TargetEnemyHero
+	}
+
+	if target, ok := targetClasses[info.ClassName]; ok {
+		return target
+	}
+
+	if info.Summon {
+		return TargetSummon
+	}
+
+	return TargetBuilding
+}
+
+/* Works out the target label for an entity targeted by a unit on the given team. */
+func ClassifyTarget(parser *manta.Parser, ent *manta.PacketEntity, team uint64) int {
+	return NewTargetInfo(parser, ent).Classify(team)
+}
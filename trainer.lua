@@ -9,6 +9,14 @@ local HIDDEN_LAYERS = 3
 local LEARNING_RATE = .1
 local TRAINING_SET_SIZE = .8 -- training/test data split (training 80%, test 20%)
 
+-- Layout of the move examples
+local MOVE_DATA_LEN = 8 -- attack flag, destination, target position and target entity mask (before the classes start)
+local USABLE_SLOTS = 8 -- inventory slots, TP scroll and neutral item, each written as ID, usable, charges, cooldown
+
+-- Weights of the move labels every example has (order type, then queued), by position among the classes. They can't be weighed by
+-- how often the label wasn't active like the others, since they always are
+local MOVE_LABEL_WEIGHTS = {[4] = 1, [5] = 1}
+
 local function CreateContainer(input_layer, output_layer, hidden_layer)
 	local net = nn.Sequential()
 
@@ -54,6 +62,19 @@ local function Loss(label_weights, class_weights)
 	return loss
 end
 
+local function BuildLoss(label_weights, class_weights)
+	local loss = nn.ParallelCriterion()
+
+	for i, label_weight in ipairs(label_weights) do -- every part of the build data is a classification
+		local nll = nn.CrossEntropyCriterion(class_weights[i])
+		nll.nll.ignoreIndex = 0
+
+		loss:add(nll, label_weight)
+	end
+
+	return loss
+end
+
 local function Train(net, data, loss, label_sizes)
 	Shuffle(data) -- for randomizing the split
 
@@ -143,6 +164,7 @@ local function ParseMoveBatch(examples, hero, team, totals)
 		local chunk_pos = 1
 		local state = 0
 		local items_pos
+		local slot_value -- position within the usable slots (4 values per slot)
 
 		local input = {}
 		local output = {}
@@ -154,10 +176,11 @@ local function ParseMoveBatch(examples, hero, team, totals)
 				if part == "items" then
 					state = 1
 					items_pos = chunk_pos
+					slot_value = 0
 					chunk_pos = 1
 
-					-- pre-fill current items with zeroes
-					for i = items_pos, items_pos + num_items - 1 do
+					-- pre-fill the slots (one-hot item + usable, charges, cooldown each), backpack and stash with zeroes
+					for i = items_pos, items_pos + USABLE_SLOTS * (num_items + 3) + num_items * 2 - 1 do
 						input[i] = 0.0
 					end
 				else
@@ -167,11 +190,29 @@ local function ParseMoveBatch(examples, hero, team, totals)
 			elseif state == 1 then -- state 1: items
 				if part == "output" then
 					state = 2
-				else
+				elseif part == "backpack" then
+					items_pos = items_pos + USABLE_SLOTS * (num_items + 3)
+				elseif part == "stash" then
+					items_pos = items_pos + num_items
+				elseif slot_value < USABLE_SLOTS * 4 then -- usable slots
+					local slot_pos = items_pos + math.floor(slot_value / 4) * (num_items + 3)
+					local field = slot_value % 4
+					local value = tonumber(part)
+
+					if field == 0 then
+						if value > 0 then -- written as ID + 1, with 0 for an empty slot
+							input[slot_pos + value - 2] = 1.0 -- that slot has that item, set it to 1
+						end
+					else
+						input[slot_pos + num_items + field - 1] = value
+					end
+
+					slot_value = slot_value + 1
+				else -- backpack or stash
 					input[(tonumber(part) - 1) + items_pos] = 1.0 -- we have that item, set it to 1
 				end
 			elseif state == 2 then -- state 2: move location
-				if chunk_pos > 3 then -- beginning of classes
+				if chunk_pos > MOVE_DATA_LEN then -- beginning of classes
 					state = 3
 					local class = tonumber(part)
 
@@ -252,6 +293,217 @@ local function ParseMoveBatch(examples, hero, team, totals)
 	end
 end
 
+local function ParseBuildBatch(examples, hero, team, totals)
+	local batch_pos = 1
+	local input_batch = {}
+	local output_batch = {}
+	local more = false
+
+	local num_items = #ability_data.items[hero][team]
+	local num_enemies = #ability_data.enemies[hero][team]
+
+	local input_view = 0
+
+	for example in examples do
+		if batch_pos > MINI_BATCH_SIZE then
+			more = true
+			break
+		end
+
+		local chunk_pos = 1
+		local state = 0
+		local items_pos
+
+		local input = {}
+		local output = {}
+
+		for part in example:gmatch("[^,]+") do
+			if state == 0 then -- state 0: input
+				if part == "items" then
+					state = 1
+					items_pos = chunk_pos
+
+					-- pre-fill the inventory, backpack, stash and enemy heroes with zeroes
+					for i = items_pos, items_pos + num_items * 3 + num_enemies - 1 do
+						input[i] = 0.0
+					end
+				else
+					input[chunk_pos] = tonumber(part)
+					chunk_pos = chunk_pos + 1
+				end
+			elseif state == 1 then -- state 1: items (inventory, backpack, stash one after another)
+				if part == "backpack" then
+					items_pos = items_pos + num_items
+				elseif part == "stash" then
+					items_pos = items_pos + num_items
+				elseif part == "enemies" then
+					state = 2
+				else
+					input[(tonumber(part) - 1) + items_pos] = 1.0
+				end
+			elseif state == 2 then -- state 2: enemy heroes (after the stash)
+				if part == "output" then
+					state = 3
+					chunk_pos = 1
+				else
+					input[(tonumber(part) - 1) + items_pos + num_items] = 1.0
+				end
+			elseif state == 3 then -- state 3: item bought
+				local class = tonumber(part)
+
+				if totals[chunk_pos] == nil then
+					totals[chunk_pos] = {}
+				end
+
+				if totals[chunk_pos][class] == nil then
+					for i = #totals[chunk_pos] + 1, class - 1 do
+						totals[chunk_pos][i] = 0
+					end
+
+					totals[chunk_pos][class] = 1
+				else
+					totals[chunk_pos][class] = totals[chunk_pos][class] + 1
+				end
+
+				output[chunk_pos] = class
+
+				chunk_pos = chunk_pos + 1
+			end
+		end
+
+		input_view = #input
+		input_batch[batch_pos] = torch.Tensor(input)
+
+		for i = 1, #output do
+			if output_batch[i] == nil then
+				output_batch[i] = {}
+			end
+
+			output_batch[i][batch_pos] = output[i]
+		end
+
+		batch_pos = batch_pos + 1
+	end
+
+	if batch_pos > 1 then
+		for i = 1, #output_batch do
+			output_batch[i] = torch.Tensor(output_batch[i])
+		end
+
+		return {torch.view(torch.cat(input_batch), -1, input_view), output_batch}, more
+	else
+		return nil, more
+	end
+end
+
+local function ParseSkillBatch(examples, hero, team, totals)
+	local batch_pos = 1
+	local input_batch = {}
+	local output_batch = {}
+	local more = false
+
+	local num_abilities = #ability_data.abilities[hero][team]
+	local num_skills = #ability_data.skills[hero][team]
+
+	local input_view = 0
+
+	for example in examples do
+		if batch_pos > MINI_BATCH_SIZE then
+			more = true
+			break
+		end
+
+		local chunk_pos = 1
+		local state = 0
+		local talents_pos
+
+		local input = {}
+		local output = {}
+
+		for part in example:gmatch("[^,]+") do
+			if state == 0 then -- state 0: time, level and ability levels
+				if part == "talents" then
+					state = 1
+					talents_pos = 3 + num_abilities -- abilities that didn't exist yet in earlier examples are left at 0
+
+					for i = chunk_pos, talents_pos + num_skills - 1 do
+						input[i] = 0.0
+					end
+				else
+					input[chunk_pos] = tonumber(part)
+					chunk_pos = chunk_pos + 1
+				end
+			elseif state == 1 then -- state 1: talents taken
+				if part == "output" then
+					state = 2
+				else
+					input[(tonumber(part) - 1) + talents_pos] = 1.0
+				end
+			elseif state == 2 then -- state 2: ability or talent leveled
+				local class = tonumber(part)
+
+				if totals[1] == nil then
+					totals[1] = {}
+				end
+
+				if totals[1][class] == nil then
+					for i = #totals[1] + 1, class - 1 do
+						totals[1][i] = 0
+					end
+
+					totals[1][class] = 1
+				else
+					totals[1][class] = totals[1][class] + 1
+				end
+
+				output[1] = class
+			end
+		end
+
+		input_view = #input
+		input_batch[batch_pos] = torch.Tensor(input)
+
+		if output_batch[1] == nil then
+			output_batch[1] = {}
+		end
+
+		output_batch[1][batch_pos] = output[1]
+
+		batch_pos = batch_pos + 1
+	end
+
+	if batch_pos > 1 then
+		output_batch[1] = torch.Tensor(output_batch[1])
+
+		return {torch.view(torch.cat(input_batch), -1, input_view), output_batch}, more
+	else
+		return nil, more
+	end
+end
+
+-- Weights for the build and skill corpora. Every example there has exactly one label (there's no "nothing" class), so each label
+-- gets a weight of 1, and classes that never came up get a weight of 0 instead of dividing by zero
+local function ClassWeights(class_counts, total, label_weights)
+	local class_weights = {}
+
+	for i, label in ipairs(class_counts) do
+		local weights = {}
+
+		for j, count in ipairs(label) do
+			if count > 0 then
+				weights[j] = total / count
+			else
+				weights[j] = 0
+			end
+		end
+
+		class_weights[i] = torch.Tensor(weights)
+		label_weights[#label_weights + 1] = 1
+	end
+
+	return label_weights, class_weights
+end
+
 local function LoadData(hero, team)
 	local path = string.format("data/%s/%d_", hero, team)
 
@@ -259,10 +511,12 @@ local function LoadData(hero, team)
 	local move_pos = 0 -- current position in the table
 	local move_total = 0 -- total number of examples (not batches)
 
-	--local items_data = {}
-	--local items_pos = 0
+	local items_data = {}
+	local items_pos = 1
+	local items_total = 0
 
 	local move_class_counts = {}
+	local items_class_counts = {}
 
 	local move_lines = io.lines(path .. "moveexamples")
 	local more = true
@@ -279,11 +533,20 @@ local function LoadData(hero, team)
 		end	
 	end
 	
-	--for example in io.lines(path .. "itemsexamples") do
-	--	item_data, item_pos, {})
+	local items_lines = io.lines(path .. "itemsexamples")
+	more = true
 
-	--	item_pos = item_pos + 1
-	--end
+	while more do
+		local batch
+
+		batch, more = ParseBuildBatch(items_lines, hero, team, items_class_counts)
+
+		if batch ~= nil then
+			items_data[items_pos] = batch
+			items_pos = items_pos + 1
+			items_total = items_total + batch[1]:size(1)
+		end
+	end
 
 	-- Calculate weights for the loss function
 	local move_label_weights = {1} -- weights of each label (move vs target vs abilities vs items...)
@@ -293,14 +556,82 @@ local function LoadData(hero, team)
 		local weights = {}
 
 		for j, total in ipairs(label) do
-			weights[j] = move_total / total -- = number of examples / number of examples with that class in the label
+			if total > 0 then
+				weights[j] = move_total / total -- = number of examples / number of examples with that class in the label
+			else
+				weights[j] = 0 -- never came up (like OrderNone)
+			end
 		end
 
 		move_class_weights[i] = torch.Tensor(weights)
-		move_label_weights[i + 1] = (label[0] or label[1]) / move_total -- number of examples where the label wasn't active / number of examples where the label was active
+		move_label_weights[i + 1] = MOVE_LABEL_WEIGHTS[i] or (label[0] or label[1]) / move_total -- number of examples where the label wasn't active / number of examples where the label was active
 	end
 
-	return move_data, items_data, move_label_weights, move_class_weights
+	local items_label_weights, items_class_weights = ClassWeights(items_class_counts, items_total, {})
+
+	return move_data, items_data, move_label_weights, move_class_weights, items_label_weights, items_class_weights
+end
+
+local function LoadSkillData(hero, team)
+	local skills_data = {}
+	local skills_pos = 1
+	local skills_total = 0
+	local skills_class_counts = {}
+
+	local skills_lines = io.lines(string.format("data/%s/%d_skillexamples", hero, team))
+	local more = true
+
+	while more do
+		local batch
+
+		batch, more = ParseSkillBatch(skills_lines, hero, team, skills_class_counts)
+
+		if batch ~= nil then
+			skills_data[skills_pos] = batch
+			skills_pos = skills_pos + 1
+			skills_total = skills_total + batch[1]:size(1)
+		end
+	end
+
+	local skills_label_weights, skills_class_weights = ClassWeights(skills_class_counts, skills_total, {})
+
+	return skills_data, skills_label_weights, skills_class_weights
+end
+
+local function TrainSkills(hero, team)
+	local skills_data, skills_label_weights, skills_class_weights = LoadSkillData(hero, team)
+
+	if #skills_data == 0 then
+		print("Missing skill build data\n")
+	else
+		local label_sizes = {#ability_data.skills[hero][team] + 1}
+
+		local input_len = skills_data[1][1]:size(2)
+		local output_len = label_sizes[1]
+
+		local skills = CreateContainer(input_len, output_len, math.floor((input_len + output_len) / 2))
+
+		print("\nSkill build:")
+		Train(skills, skills_data, BuildLoss(skills_label_weights, skills_class_weights), label_sizes)
+		torch.save("data/" .. hero .. "/nets/" .. team .. "_skills", skills, "ascii")
+	end
+end
+
+local function TrainBuild(hero, team, items_data, items_label_weights, items_class_weights)
+	if #items_data == 0 then
+		print("Missing build data\n")
+	else
+		local label_sizes = {#ability_data.items[hero][team] + 1}
+
+		local input_len = items_data[1][1]:size(2)
+		local output_len = label_sizes[1]
+
+		local items = CreateContainer(input_len, output_len, math.floor((input_len + output_len) / 2))
+
+		print("\nItems/build:")
+		Train(items, items_data, BuildLoss(items_label_weights, items_class_weights), label_sizes)
+		torch.save("data/" .. hero .. "/nets/" .. team .. "_items", items, "ascii")
+	end
 end
 
 for hero in paths.iterdirs("data") do
@@ -310,46 +641,54 @@ for hero in paths.iterdirs("data") do
 	do
 		print("\nRadiant")
 
-		local move_data, items_data, move_label_weights, move_class_weights = LoadData(hero, 2)
+		local move_data, items_data, move_label_weights, move_class_weights, items_label_weights, items_class_weights = LoadData(hero, 2)
 
 		if #move_data == 0 then
 			print("Missing training data\n")
 		else
 			local input_len = move_data[1][1]:size(2)
-			local output_len = 13 + #ability_data.activeAbilities[hero][2] + #ability_data.activeItems[hero][2]
+			local label_sizes = {MOVE_DATA_LEN, #ability_data.targets, #ability_data.activeAbilities[hero][2] + 1, #ability_data.activeItems[hero][2] + 1, #ability_data.orders, 2}
+			local output_len = 0
+
+			for _, size in ipairs(label_sizes) do
+				output_len = output_len + size
+			end
 
 			local move = CreateContainer(input_len, output_len, math.floor((input_len + output_len) / 2))
 
 			print("\nMoving:")
-			Train(move, move_data, Loss(move_label_weights, move_class_weights), {3, 8, #ability_data.activeAbilities[hero][2] + 1, #ability_data.activeItems[hero][2] + 1})
+			Train(move, move_data, Loss(move_label_weights, move_class_weights), label_sizes)
 			torch.save("data/" .. hero .. "/nets/2_move", move, "ascii")
-
-			--print("Items/build:")
-			--Train(items, items_data, .1, nn.ClassNLLCriterion(), items_size)
-			--torch.save(move, "../data" .. hero .. "2_itemsnn")
 		end
+
+		TrainBuild(hero, 2, items_data, items_label_weights, items_class_weights)
+		TrainSkills(hero, 2)
 	end
 
 	do
 		print("\nDire")
 
-		local move_data, items_data, move_label_weights, move_class_weights = LoadData(hero, 3)
+		local move_data, items_data, move_label_weights, move_class_weights, items_label_weights, items_class_weights = LoadData(hero, 3)
 
 		if #move_data == 0 then
 			print("Missing training data\n")
 		else
 			local input_len = move_data[1][1]:size(2)
-			local output_len = 13 + #ability_data.activeAbilities[hero][3] + #ability_data.activeItems[hero][3]
+			local label_sizes = {MOVE_DATA_LEN, #ability_data.targets, #ability_data.activeAbilities[hero][3] + 1, #ability_data.activeItems[hero][3] + 1, #ability_data.orders, 2}
+			local output_len = 0
+
+			for _, size in ipairs(label_sizes) do
+				output_len = output_len + size
+			end
 
 			local move = CreateContainer(input_len, output_len, math.floor((input_len + output_len) / 2))
 
 			print("\nMoving:")
-			Train(move, move_data, Loss(move_label_weights, move_class_weights), {3, 8, #ability_data.activeAbilities[hero][3] + 1, #ability_data.activeItems[hero][3] + 1})
+			Train(move, move_data, Loss(move_label_weights, move_class_weights), label_sizes)
 			torch.save("data/" .. hero .. "/nets/3_move", move, "ascii")
-
-			--print("Items/build:")
-			--Train(items, items_data, .1, nn.ClassNLLCriterion(), items_size)
-			--torch.save(move, "../data" .. hero .. "3_itemsnn")
 		end
+
+		TrainBuild(hero, 3, items_data, items_label_weights, items_class_weights)
+		TrainSkills(hero, 3)
 	end
 end
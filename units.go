@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/dotabuff/manta"
+)
+
+/* Kinds of units a player can give orders to. */
+const (
+	UnitHero = iota + 1
+	UnitIllusion
+	UnitClone // Meepo clones, Tempest Doubles and anything else that's a real hero but not the player's own
+	UnitSummon
+)
+
+/* Illusions point to the hero they're copying, everything else has a null handle. */
+func IsIllusion(ent *manta.PacketEntity) bool {
+	handle, ok := ent.FetchUint32("m_hReplicatingOtherHeroModel")
+
+	return ok && handle != 0 && handle&HANDLE_MAGIC != HANDLE_MAGIC
+}
+
+/*
+	Figures out whose unit an order was given to.
+	Returns the hero the order counts towards (the unit itself for heroes, illusions and clones, the owning hero for summons like
+	Lone Druid's bear) and the kind of unit. Returns nil if the unit isn't controlled by a player.
+*/
+func ResolveUnit(parser *manta.Parser, heroes map[int32]*Hero, ent *manta.PacketEntity) (*manta.PacketEntity, int) {
+	if IsHero(ent) {
+		if hero, ok := heroes[ent.Index]; ok {
+			if hero.Illusion {
+				return ent, UnitIllusion
+			} else if hero.Clone {
+				return ent, UnitClone
+			}
+		}
+
+		return ent, UnitHero
+	}
+
+	if owner_handle, ok := ent.FetchUint32("m_hOwnerEntity"); ok {
+		if owner, ok := parser.PacketEntities[int32(owner_handle&HANDLE_MAGIC)]; ok && IsHero(owner) {
+			return owner, UnitSummon
+		}
+	}
+
+	return nil, 0
+}